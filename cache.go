@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// tempCredentials are temporary STS credentials along with the time at which
+// they expire. A zero Expiration means the credentials do not expire.
+type tempCredentials struct {
+	credentials.Value
+	Expiration time.Time
+
+	// AssumedRoleARN is the ARN of the assumed role session.
+	AssumedRoleARN string
+
+	// RoleSessionName is the session name the role was assumed with.
+	RoleSessionName string
+
+	// SourceProfile is the profile whose credentials assumed the role.
+	SourceProfile string
+
+	// Region is the region configured for the role.
+	Region string
+
+	// Tags are the session's tags, including those carried over from the
+	// session that assumed it, and TransitiveTagKeys the keys of those that
+	// carry over to roles it assumes.
+	Tags              map[string]string `json:",omitempty"`
+	TransitiveTagKeys []string          `json:",omitempty"`
+}
+
+// expired reports whether the credentials expire within the given window.
+func (c *tempCredentials) expired(window time.Duration) bool {
+	if c.Expiration.IsZero() {
+		return false
+	}
+	return time.Now().Add(window).After(c.Expiration)
+}
+
+// credentialCache stores temporary credentials in a keyring so that they can
+// be reused across invocations until shortly before they expire.
+type credentialCache struct {
+	// Keyring is where cached credentials are stored.
+	Keyring keyring
+
+	// Window is how long before expiration cached credentials are
+	// considered stale.
+	Window time.Duration
+}
+
+// cacheKey returns a stable keyring key for the given key components.
+func cacheKey(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached credentials for key, or nil if there are none or they
+// are about to expire.
+func (c *credentialCache) Get(key string) (*tempCredentials, error) {
+	raw, err := c.Keyring.Get(key)
+	if err == errKeyNotFound || err == errWrongPassphrase {
+		// An entry from another passphrase is treated as a miss and will be
+		// overwritten.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var creds tempCredentials
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		// A corrupt entry is treated as a miss and will be overwritten.
+		return nil, nil
+	}
+	if creds.expired(c.Window) {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// Set stores creds in the cache under key.
+func (c *credentialCache) Set(key string, creds *tempCredentials) error {
+	raw, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	return c.Keyring.Set(key, raw)
+}
+
+// Fetch returns the cached credentials for key if they are still valid, else
+// it calls retrieve and caches the result. A nil cache always calls retrieve.
+func (c *credentialCache) Fetch(key string, retrieve func() (*tempCredentials, error)) (*tempCredentials, error) {
+	if c == nil {
+		return retrieve()
+	}
+
+	creds, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		return creds, nil
+	}
+
+	creds, err = retrieve()
+	if err != nil {
+		return nil, err
+	}
+
+	// Long lived credentials (e.g. a profile with static keys) are never
+	// cached.
+	if creds.Expiration.IsZero() {
+		return creds, nil
+	}
+	return creds, c.Set(key, creds)
+}
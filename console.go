@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// signinToken calls getSigninToken on the federation endpoint for creds
+// (https://docs.aws.amazon.com/IAM/latest/UserGuide/id_roles_providers_enable-console-custom-url.html). A
+// zero duration leaves the console session duration to AWS.
+func signinToken(endpoint string, creds *tempCredentials, duration time.Duration) (string, error) {
+	if creds.SessionToken == "" {
+		return "", errors.New("console sign-in requires temporary credentials")
+	}
+
+	session, err := json.Marshal(map[string]string{
+		"sessionId":    creds.AccessKeyID,
+		"sessionKey":   creds.SecretAccessKey,
+		"sessionToken": creds.SessionToken,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("Action", "getSigninToken")
+	q.Set("Session", string(session))
+	if duration > 0 {
+		q.Set("SessionDuration", fmt.Sprint(int64(duration/time.Second)))
+	}
+
+	resp, err := http.Get(endpoint + "?" + q.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s responded with %s", endpoint, resp.Status)
+	}
+
+	var token struct {
+		SigninToken string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("%s: %v", endpoint, err)
+	}
+	if token.SigninToken == "" {
+		return "", fmt.Errorf("%s did not return a sign-in token", endpoint)
+	}
+	return token.SigninToken, nil
+}
+
+// consoleLoginURL returns the URL that signs in to the console with token and
+// then redirects to destination, which may be a full URL or a path in the
+// console at consoleURL.
+func consoleLoginURL(endpoint, token, consoleURL, destination string) string {
+	if strings.HasPrefix(destination, "/") {
+		destination = consoleURL + destination
+	}
+
+	q := url.Values{}
+	q.Set("Action", "login")
+	q.Set("Issuer", "assume-role")
+	q.Set("Destination", destination)
+	q.Set("SigninToken", token)
+	return endpoint + "?" + q.Encode()
+}
+
+// openBrowser opens u with the desktop's default browser.
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Run()
+}
+
+// console implements `assume-role console`, which signs in to the AWS console
+// as a role.
+func console(args []string, opts *options) error {
+	fs := flag.NewFlagSet("console", flag.ExitOnError)
+	var (
+		open        = fs.Bool("open", false, "Open the URL in a browser instead of printing it.")
+		destination = fs.String("destination", "/", "The console page to go to after signing in, as a path or URL.")
+		duration    = fs.Duration("session-duration", 0, "The duration of the console session, between 15m and 12h.")
+		endpoint    = fs.String("federation-url", "", "Override the federation endpoint, e.g. for testing.")
+	)
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	role := fs.Arg(0)
+
+	creds, err := retrieveCredentials(role, opts)
+	if err != nil {
+		return err
+	}
+
+	// The console is in the partition of the assumed role.
+	p := arnPartition(creds.AssumedRoleARN)
+	if *endpoint == "" {
+		*endpoint = p.FederationURL
+	}
+
+	token, err := signinToken(*endpoint, creds, *duration)
+	if err != nil {
+		return err
+	}
+	u := consoleLoginURL(*endpoint, token, p.ConsoleURL, *destination)
+
+	if *open {
+		return openBrowser(u)
+	}
+	fmt.Println(u)
+	return nil
+}
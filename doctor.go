@@ -0,0 +1,365 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+var (
+	// mfaArnRe matches the ARN of a virtual or U2F MFA device. Hardware
+	// devices are identified by their serial number instead.
+	mfaArnRe     = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:(mfa|u2f)/.+$`)
+	mfaSerialRe  = regexp.MustCompile(`^[\w+=/:,.@-]{9,256}$`)
+	accountRe    = regexp.MustCompile(`^[0-9]{12}$`)
+	externalIDRe = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+)
+
+// maxClockSkew is how far the local clock may be off before STS rejects
+// signed requests.
+const maxClockSkew = 5 * time.Minute
+
+// finding is a problem found by `assume-role doctor`.
+type finding struct {
+	// Error is true for problems that break a profile, and false for
+	// warnings.
+	Error bool
+
+	// Where is the profile or file the problem is in.
+	Where   string
+	Message string
+}
+
+func (f finding) String() string {
+	severity := "WARNING"
+	if f.Error {
+		severity = "ERROR"
+	}
+	return fmt.Sprintf("%s: %s: %s", severity, f.Where, f.Message)
+}
+
+// doctor collects findings.
+type doctor struct {
+	findings []finding
+}
+
+func (d *doctor) errorf(where, format string, args ...interface{}) {
+	d.findings = append(d.findings, finding{Error: true, Where: where, Message: fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) warnf(where, format string, args ...interface{}) {
+	d.findings = append(d.findings, finding{Where: where, Message: fmt.Sprintf(format, args...)})
+}
+
+// checkRoleARN checks that arn is a valid role ARN.
+func (d *doctor) checkRoleARN(where, arn string) {
+	m := roleArnRe.FindStringSubmatch(arn)
+	switch {
+	case m == nil:
+		d.errorf(where, "role_arn %q is not a role ARN like arn:aws:iam::123456789012:role/Name", arn)
+	case arnPartition(arn).ID != m[1]:
+		d.errorf(where, "role_arn %q is in an unknown partition %q", arn, m[1])
+	case !accountRe.MatchString(m[2]):
+		d.errorf(where, "role_arn %q has an invalid account ID %q, which must be 12 digits", arn, m[2])
+	}
+}
+
+// checkMFASerial checks that mfa is a valid MFA device ARN or serial number.
+func (d *doctor) checkMFASerial(where, mfa string) {
+	if strings.HasPrefix(mfa, "arn:") {
+		if !mfaArnRe.MatchString(mfa) {
+			d.errorf(where, "mfa_serial %q is not an MFA device ARN like arn:aws:iam::123456789012:mfa/user", mfa)
+		}
+		return
+	}
+	if !mfaSerialRe.MatchString(mfa) {
+		d.errorf(where, "mfa_serial %q is neither an MFA device ARN nor a hardware serial number", mfa)
+	}
+}
+
+// checkExternalID checks that a configured external_id is one STS allows.
+func (d *doctor) checkExternalID(where, id string) {
+	if id != "" && (len(id) < 2 || len(id) > 1224 || !externalIDRe.MatchString(id)) {
+		d.errorf(where, "external_id %q must be 2 to 1224 letters, digits or any of _+=,.@:/-", id)
+	}
+}
+
+// checkDuration checks that a configured duration_seconds is one STS allows.
+func (d *doctor) checkDuration(where string, duration time.Duration) {
+	if duration != 0 && (duration < 15*time.Minute || duration > 12*time.Hour) {
+		d.errorf(where, "duration_seconds %d is not between 900 and 43200", int64(duration/time.Second))
+	}
+}
+
+// checkSessionPolicy checks that a configured session policy is valid JSON and
+// within the limits of STS.
+func (d *doctor) checkSessionPolicy(where, policy string, arns []string) {
+	if _, err := parseSessionPolicy(policy, arns); err != nil {
+		d.errorf(where, "%v", err)
+	}
+}
+
+// checkTags checks configured session tags.
+func (d *doctor) checkTags(where string, tags sessionTags) {
+	if err := tags.Validate(); err != nil {
+		d.errorf(where, "%v", err)
+	}
+}
+
+// checkFile checks that the file at path, if it exists, is readable and,
+// when it holds secrets, not readable by others.
+func (d *doctor) checkFile(path string, secret bool) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		d.errorf(path, "%v", err)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		d.errorf(path, "can't be read: %v", err)
+		return
+	}
+	f.Close()
+
+	if secret && fi.Mode().Perm()&0077 != 0 {
+		d.warnf(path, "is readable by other users (mode %o), run chmod 600 %s", fi.Mode().Perm(), path)
+	}
+}
+
+// checkDuplicates warns about profiles that are in both the config and
+// credentials files, as the credentials file silently takes precedence.
+func (d *doctor) checkDuplicates() {
+	config, err := ini.LooseLoad(sharedConfigFilename())
+	if err != nil {
+		d.errorf(sharedConfigFilename(), "%v", err)
+		return
+	}
+	creds, err := ini.LooseLoad(sharedCredentialsFilename())
+	if err != nil {
+		d.errorf(sharedCredentialsFilename(), "%v", err)
+		return
+	}
+
+	inCredentials := make(map[string]*ini.Section)
+	for _, section := range creds.Sections() {
+		inCredentials[section.Name()] = section
+	}
+
+	for _, section := range config.Sections() {
+		name := strings.TrimSpace(strings.TrimPrefix(section.Name(), "profile "))
+		other, ok := inCredentials[name]
+		if !ok || name == ini.DEFAULT_SECTION && len(section.Keys()) == 0 {
+			continue
+		}
+		for _, key := range section.KeyStrings() {
+			if other.HasKey(key) {
+				d.warnf(name, "%s is set in both %s and %s, the latter takes precedence", key, sharedConfigFilename(), sharedCredentialsFilename())
+			}
+		}
+	}
+}
+
+// checkProfiles checks every profile in the AWS CLI config and credentials
+// files.
+func (d *doctor) checkProfiles() {
+	profiles, err := loadProfiles()
+	if err != nil {
+		d.errorf(sharedConfigFilename(), "%v", err)
+		return
+	}
+
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prof := profiles[name]
+
+		if (prof.AccessKeyID == "") != (prof.SecretAccessKey == "") {
+			d.errorf(name, "has only one of aws_access_key_id and aws_secret_access_key")
+		}
+		if prof.MFASerial != "" {
+			d.checkMFASerial(name, prof.MFASerial)
+		}
+		if prof.RoleARN == "" {
+			continue
+		}
+
+		d.checkRoleARN(name, prof.RoleARN)
+		d.checkExternalID(name, prof.ExternalID)
+		d.checkSessionPolicy(name, prof.SessionPolicy, splitList(prof.SessionPolicyARNs))
+		if tags, err := parseTags(splitList(prof.Tags), splitList(prof.TransitiveTags)); err != nil {
+			d.errorf(name, "%v", err)
+		} else if !tags.IsZero() && prof.HasWebIdentity() {
+			d.errorf(name, "has tags, which can't be set for a web identity role")
+		}
+		if duration, err := prof.Duration(); err != nil {
+			d.errorf(name, "%v", err)
+		} else {
+			d.checkDuration(name, duration)
+		}
+		if prof.SourceProfile != "" && prof.CredentialSource != "" {
+			d.errorf(name, "has both source_profile and credential_source, only one may be set")
+		}
+		if prof.WebIdentityTokenFile != "" {
+			if _, err := os.Stat(prof.WebIdentityTokenFile); err != nil {
+				d.warnf(name, "web_identity_token_file: %v", err)
+			}
+		}
+		if _, err := profiles.Chain(name); err != nil {
+			d.errorf(name, "%v", err)
+		}
+	}
+}
+
+// checkRolesFile checks the roles in the deprecated roles file.
+func (d *doctor) checkRolesFile() {
+	if _, err := os.Stat(configFilePath); err != nil {
+		return
+	}
+	d.warnf(configFilePath, "is deprecated and takes precedence over %s, run assume-role migrate", sharedConfigFilename())
+
+	config, err := loadConfig()
+	if err != nil {
+		d.errorf(configFilePath, "%v", err)
+		return
+	}
+
+	var names []string
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		roleConfig := config[name]
+		where := fmt.Sprintf("%s in %s", name, configFilePath)
+		d.checkRoleARN(where, roleConfig.Role)
+		d.checkExternalID(where, roleConfig.ExternalID)
+		d.checkSessionPolicy(where, roleConfig.SessionPolicy, roleConfig.SessionPolicyARNs)
+		d.checkTags(where, sessionTags{Tags: roleConfig.Tags, Transitive: roleConfig.TransitiveTags})
+		d.checkDuration(where, time.Duration(roleConfig.DurationSeconds)*time.Second)
+		if roleConfig.MFA != "" {
+			d.checkMFASerial(where, roleConfig.MFA)
+		}
+	}
+}
+
+// checkScopes checks the session policies of the scopes in the settings file.
+func (d *doctor) checkScopes() {
+	settings, err := loadSettings()
+	if err != nil {
+		d.errorf(settingsFilePath, "%v", err)
+		return
+	}
+
+	var names []string
+	for name := range settings.Scopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		scope := settings.Scopes[name]
+		d.checkSessionPolicy(fmt.Sprintf("scope %s in %s", name, settingsFilePath), scope.Policy, scope.PolicyARNs)
+	}
+}
+
+// checkClock compares the local clock with the Date header of a response from
+// STS, as signed requests are rejected when the clocks differ too much.
+func (d *doctor) checkClock() {
+	endpoint := "https://sts.amazonaws.com/"
+	if stsEndpoint != "" {
+		endpoint = stsEndpoint
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	start := time.Now()
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		d.warnf(endpoint, "can't check the clock: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		d.warnf(endpoint, "can't check the clock, the response has no valid Date header")
+		return
+	}
+
+	// The Date header has a resolution of a second, and the request takes
+	// a while, so allow for both.
+	local := start.Add(time.Since(start) / 2)
+	skew := local.Sub(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	switch {
+	case skew > maxClockSkew:
+		d.errorf("clock", "the local clock is %s off from STS, requests will be rejected until it is synchronized", skew/time.Second*time.Second)
+	case skew > time.Minute:
+		d.warnf("clock", "the local clock is %s off from STS", skew/time.Second*time.Second)
+	}
+}
+
+// doctorCommand implements `assume-role doctor`, which checks the
+// configuration for problems. It fails if any are errors, or with -strict if
+// there are any at all.
+func doctorCommand(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	var (
+		offline = fs.Bool("offline", false, "Skip checks that need the network.")
+		strict  = fs.Bool("strict", false, "Fail on warnings as well as errors.")
+	)
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	d := &doctor{}
+	d.checkFile(sharedConfigFilename(), false)
+	d.checkFile(sharedCredentialsFilename(), true)
+	d.checkFile(configFilePath, false)
+	d.checkDuplicates()
+	d.checkProfiles()
+	d.checkRolesFile()
+	d.checkScopes()
+	if !*offline {
+		d.checkClock()
+	}
+
+	var errors, warnings int
+	for _, f := range d.findings {
+		fmt.Println(f)
+		if f.Error {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	if len(d.findings) == 0 {
+		fmt.Println("No problems found.")
+		return nil
+	}
+	if errors > 0 || *strict && warnings > 0 {
+		return fmt.Errorf("found %d errors and %d warnings", errors, warnings)
+	}
+	return nil
+}
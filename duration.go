@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// maxChainedDuration is the longest duration AWS allows for a role assumed
+// with the credentials of another role.
+const maxChainedDuration = time.Hour
+
+// isDurationError reports whether err is STS rejecting a DurationSeconds
+// longer than the role's MaxSessionDuration.
+func isDurationError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "DurationSeconds")
+}
+
+// assumeRoleWithLongestDuration assumes a role that doesn't allow duration
+// with the longest duration it does allow. STS doesn't say what the limit is,
+// so it is searched for: to the second by bisection, or in whole hours when
+// an MFA code is needed, as only one request may succeed with it.
+func assumeRoleWithLongestDuration(sess *session.Session, role *roleInput, duration time.Duration) (*tempCredentials, error) {
+	search := bisectDuration
+	if role.MFASerial != "" {
+		search = stepDownDuration
+	}
+	creds, allowed, err := search(sess, role, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s doesn't allow a duration of %s, credentials are valid for %s instead\n",
+		role.RoleARN, duration, allowed)
+	return creds, nil
+}
+
+// stepDownDuration tries shorter durations than duration in whole hours until
+// one is allowed. Stopping at the first success means only one request ever
+// succeeds, so an MFA code is never used twice.
+func stepDownDuration(sess *session.Session, role *roleInput, duration time.Duration) (*tempCredentials, time.Duration, error) {
+	for hours := int((duration - 1) / time.Hour); hours >= 1; hours-- {
+		allowed := time.Duration(hours) * time.Hour
+		creds, err := assumeRole(sess, role, allowed)
+		if isDurationError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return creds, allowed, nil
+	}
+	return nil, 0, fmt.Errorf("%s doesn't allow a duration of even 1h", role.RoleARN)
+}
+
+// bisectDuration finds the longest duration shorter than duration that is
+// allowed, to the second, keeping the credentials of the longest one.
+func bisectDuration(sess *session.Session, role *roleInput, duration time.Duration) (*tempCredentials, time.Duration, error) {
+	var (
+		best    *tempCredentials
+		allowed time.Duration
+		lo, hi  = int64(time.Hour / time.Second), int64((duration - time.Second) / time.Second)
+	)
+	for lo <= hi {
+		seconds := (lo + hi) / 2
+		creds, err := assumeRole(sess, role, time.Duration(seconds)*time.Second)
+		switch {
+		case err == nil:
+			best, allowed, lo = creds, time.Duration(seconds)*time.Second, seconds+1
+		case isDurationError(err):
+			hi = seconds - 1
+		case best != nil:
+			// Settle for the credentials already retrieved.
+			return best, allowed, nil
+		default:
+			return nil, 0, err
+		}
+	}
+	if best == nil {
+		return nil, 0, fmt.Errorf("%s doesn't allow a duration of even 1h", role.RoleARN)
+	}
+	return best, allowed, nil
+}
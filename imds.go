@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	imdsTokenHeader    = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	// imdsMaxTokenTTL is the longest session token lifetime EC2 allows.
+	imdsMaxTokenTTL = 6 * time.Hour
+
+	imdsCredentialsPath = "/latest/meta-data/iam/security-credentials"
+)
+
+// metadataServer emulates the parts of the EC2 instance metadata service that
+// provide instance profile credentials, including IMDSv2 session tokens.
+type metadataServer struct {
+	Credentials *refreshingCredentials
+
+	// RoleName is the instance profile role name that credentials are
+	// served under.
+	RoleName string
+
+	mu     sync.Mutex
+	tokens map[string]time.Time // expiration by token
+}
+
+// metadataCredentials is the response body of the security credentials
+// endpoint, as consumed by the ec2rolecreds provider.
+type metadataCredentials struct {
+	Code            string
+	LastUpdated     time.Time
+	Type            string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (s *metadataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/api/token" {
+		s.serveToken(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Requests without a token are IMDSv1 and always allowed, but a token
+	// that is present must be valid.
+	if token := r.Header.Get(imdsTokenHeader); token != "" && !s.validToken(token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case imdsCredentialsPath:
+		fmt.Fprint(w, s.RoleName)
+	case imdsCredentialsPath + "/" + s.RoleName:
+		creds, err := s.Credentials.Get()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		expiration := creds.Expiration
+		if expiration.IsZero() {
+			// Instance profile credentials always expire, so make
+			// long lived credentials look like they are refreshed
+			// regularly.
+			expiration = time.Now().Add(time.Hour)
+		}
+
+		writeJSON(w, http.StatusOK, &metadataCredentials{
+			Code:            "Success",
+			LastUpdated:     time.Now().UTC(),
+			Type:            "AWS-HMAC",
+			AccessKeyID:     creds.AccessKeyID,
+			SecretAccessKey: creds.SecretAccessKey,
+			Token:           creds.SessionToken,
+			Expiration:      expiration.UTC(),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveToken issues an IMDSv2 session token.
+func (s *metadataServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seconds, err := strconv.Atoi(r.Header.Get(imdsTokenTTLHeader))
+	ttl := time.Duration(seconds) * time.Second
+	if err != nil || ttl <= 0 || ttl > imdsMaxTokenTTL {
+		http.Error(w, "invalid token ttl", http.StatusBadRequest)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(raw)
+
+	s.mu.Lock()
+	now := time.Now()
+	if s.tokens == nil {
+		s.tokens = make(map[string]time.Time)
+	}
+	for t, expiration := range s.tokens {
+		if now.After(expiration) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = now.Add(ttl)
+	s.mu.Unlock()
+
+	w.Header().Set(imdsTokenTTLHeader, strconv.Itoa(seconds))
+	fmt.Fprint(w, token)
+}
+
+func (s *metadataServer) validToken(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiration, ok := s.tokens[token]
+	return ok && time.Now().Before(expiration)
+}
+
+// imds implements `assume-role imds`, which emulates the EC2 instance metadata
+// service for a role until interrupted.
+func imds(args []string, opts *options) error {
+	role, creds, ln, err := listenForRole("imds", "127.0.0.1:9911", args, opts)
+	if err != nil {
+		return err
+	}
+
+	printEnv(opts.Format, [][2]string{
+		{"AWS_EC2_METADATA_SERVICE_ENDPOINT", fmt.Sprintf("http://%s/", ln.Addr())},
+	})
+	fmt.Fprintf(os.Stderr, "Serving instance metadata for %s on %s\n", role, ln.Addr())
+	return http.Serve(ln, &metadataServer{
+		Credentials: creds,
+		RoleName:    imdsRoleName(role),
+	})
+}
+
+// imdsRoleName returns the name that credentials for role are served under,
+// which must be a single path segment.
+func imdsRoleName(role string) string {
+	if roleArnRe.MatchString(role) {
+		return role[strings.LastIndex(role, "/")+1:]
+	}
+	return strings.Replace(role, "/", "-", -1)
+}
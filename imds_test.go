@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newTestMetadataServer returns an instance metadata service emulator that
+// serves fixed credentials for the role prod.
+func newTestMetadataServer() *httptest.Server {
+	return httptest.NewServer(&metadataServer{
+		Credentials: &refreshingCredentials{
+			Retrieve: func() (*tempCredentials, error) {
+				return &tempCredentials{
+					Value: credentials.Value{
+						AccessKeyID:     "ASIAEXAMPLE",
+						SecretAccessKey: "secret",
+						SessionToken:    "token",
+					},
+					Expiration: time.Now().Add(time.Hour),
+				}, nil
+			},
+		},
+		RoleName: "prod",
+	})
+}
+
+func TestMetadataServerCredentials(t *testing.T) {
+	srv := newTestMetadataServer()
+	defer srv.Close()
+
+	// The vendored SDK only speaks IMDSv1.
+	client := ec2metadata.New(session.Must(session.NewSession()), &aws.Config{
+		Endpoint: aws.String(srv.URL + "/latest"),
+	})
+	value, err := ec2rolecreds.NewCredentialsWithClient(client).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "ASIAEXAMPLE" || value.SecretAccessKey != "secret" || value.SessionToken != "token" {
+		t.Errorf("credentials = %+v, want the ones served", value)
+	}
+}
+
+// imdsRequest makes a request to the emulator with the given headers and
+// returns the response status and body.
+func imdsRequest(t *testing.T, method, url string, headers map[string]string) (int, string) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMetadataServerToken(t *testing.T) {
+	srv := newTestMetadataServer()
+	defer srv.Close()
+
+	status, token := imdsRequest(t, "PUT", srv.URL+"/latest/api/token", map[string]string{
+		imdsTokenTTLHeader: "60",
+	})
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("PUT token = %d %q, want a token", status, token)
+	}
+
+	status, role := imdsRequest(t, "GET", srv.URL+imdsCredentialsPath+"/", map[string]string{
+		imdsTokenHeader: token,
+	})
+	if status != http.StatusOK || role != "prod" {
+		t.Errorf("GET with token = %d %q, want 200 prod", status, role)
+	}
+
+	status, _ = imdsRequest(t, "GET", srv.URL+imdsCredentialsPath+"/prod", map[string]string{
+		imdsTokenHeader: "invalid",
+	})
+	if status != http.StatusUnauthorized {
+		t.Errorf("GET with invalid token = %d, want 401", status)
+	}
+}
+
+func TestMetadataServerTokenTTL(t *testing.T) {
+	srv := newTestMetadataServer()
+	defer srv.Close()
+
+	for _, ttl := range []string{"", "0", "21601", "soon"} {
+		status, _ := imdsRequest(t, "PUT", srv.URL+"/latest/api/token", map[string]string{
+			imdsTokenTTLHeader: ttl,
+		})
+		if status != http.StatusBadRequest {
+			t.Errorf("PUT token with ttl %q = %d, want 400", ttl, status)
+		}
+	}
+
+	if status, _ := imdsRequest(t, "GET", srv.URL+"/latest/api/token", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET token = %d, want 405", status)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// errKeyNotFound is returned by a keyring when there is no item for a key.
+var errKeyNotFound = errors.New("keyring: key not found")
+
+// errWrongPassphrase is returned by an encrypted keyring when an item can't be
+// decrypted with the passphrase.
+var errWrongPassphrase = errors.New("keyring: unable to decrypt, wrong passphrase?")
+
+// keyring stores opaque items by key. The credential cache is built on top of
+// it so that new storage (e.g. an OS keychain) only needs to implement this
+// interface and register itself in keyringBackends.
+type keyring interface {
+	// Get returns the item stored under key, or errKeyNotFound.
+	Get(key string) ([]byte, error)
+
+	// Set stores data under key, replacing any existing item.
+	Set(key string, data []byte) error
+
+	// Remove deletes the item stored under key, if any.
+	Remove(key string) error
+}
+
+// keyringBackends maps the names accepted by the `keyring` setting to a
+// function that opens that keyring in the given directory.
+var keyringBackends = map[string]func(dir string) keyring{
+	"file": func(dir string) keyring {
+		return &fileKeyring{Dir: dir, Ext: ".json"}
+	},
+	"encrypted-file": func(dir string) keyring {
+		return &encryptedKeyring{
+			keyring:    &fileKeyring{Dir: dir, Ext: ".enc"},
+			Passphrase: envOrPromptPassphrase,
+		}
+	},
+}
+
+// defaultKeyring is the keyring used when none is configured.
+const defaultKeyring = "file"
+
+// openKeyring returns the named keyring backend rooted at dir.
+func openKeyring(name, dir string) (keyring, error) {
+	if name == "" {
+		name = defaultKeyring
+	}
+	open, ok := keyringBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyring %q", name)
+	}
+	return open(dir), nil
+}
+
+// fileKeyring stores each item as a plaintext file that only the current user
+// can read.
+type fileKeyring struct {
+	Dir string
+	Ext string
+}
+
+func (k *fileKeyring) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(k.path(key))
+	if os.IsNotExist(err) {
+		return nil, errKeyNotFound
+	}
+	return data, err
+}
+
+func (k *fileKeyring) Set(key string, data []byte) error {
+	if err := os.MkdirAll(k.Dir, 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that concurrent invocations never
+	// observe a partially written item.
+	tmp, err := ioutil.TempFile(k.Dir, key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path(key))
+}
+
+func (k *fileKeyring) Remove(key string) error {
+	err := os.Remove(k.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (k *fileKeyring) path(key string) string {
+	return filepath.Join(k.Dir, key+k.Ext)
+}
+
+// removeFiles removes the files in dir with the extension ext, ignoring
+// errors.
+func removeFiles(dir, ext string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"+ext))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// Parameters for deriving encryption keys from a passphrase with scrypt.
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeyLen  = 32
+	scryptSaltLen = 16
+)
+
+// encryptedMagic prefixes every item written by encryptedKeyring so that the
+// format can be changed later.
+var encryptedMagic = []byte("ar1\x00")
+
+// encryptedKeyring wraps another keyring and encrypts items with AES-GCM
+// using a key derived from a passphrase. Each item has its own random salt and
+// nonce, stored alongside the ciphertext.
+type encryptedKeyring struct {
+	keyring
+
+	// Passphrase returns the passphrase. It is called at most once.
+	Passphrase func() (string, error)
+
+	once       sync.Once
+	passphrase []byte
+	err        error
+
+	mu   sync.Mutex
+	keys map[string][]byte // derived keys by salt
+}
+
+func (k *encryptedKeyring) Get(key string) ([]byte, error) {
+	data, err := k.keyring.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return nil, fmt.Errorf("keyring: %s is not an encrypted item", key)
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < scryptSaltLen {
+		return nil, fmt.Errorf("keyring: %s is truncated", key)
+	}
+	salt, data := data[:scryptSaltLen], data[scryptSaltLen:]
+
+	aead, err := k.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("keyring: %s is truncated", key)
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func (k *encryptedKeyring) Set(key string, data []byte) error {
+	salt := make([]byte, scryptSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	aead, err := k.aead(salt)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encryptedMagic)
+	buf.Write(salt)
+	buf.Write(nonce)
+	buf.Write(aead.Seal(nil, nonce, data, []byte(key)))
+	return k.keyring.Set(key, buf.Bytes())
+}
+
+// aead returns an AES-GCM cipher keyed from the passphrase and salt.
+func (k *encryptedKeyring) aead(salt []byte) (cipher.AEAD, error) {
+	k.once.Do(func() {
+		var passphrase string
+		passphrase, k.err = k.Passphrase()
+		if k.err == nil && passphrase == "" {
+			k.err = errors.New("keyring: empty passphrase")
+		}
+		k.passphrase = []byte(passphrase)
+	})
+	if k.err != nil {
+		return nil, k.err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[string(salt)]
+	if !ok {
+		var err error
+		key, err = scrypt.Key(k.passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+		if err != nil {
+			return nil, err
+		}
+		if k.keys == nil {
+			k.keys = make(map[string][]byte)
+		}
+		k.keys[string(salt)] = key
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// envOrPromptPassphrase returns the keyring passphrase from the
+// ASSUME_ROLE_PASSPHRASE environment variable, or prompts for it on the
+// terminal.
+func envOrPromptPassphrase() (string, error) {
+	if passphrase := os.Getenv("ASSUME_ROLE_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	return readPassphrase("Keyring passphrase: ")
+}
+
+// readPassphrase prompts for a passphrase on the controlling terminal with
+// echo disabled.
+func readPassphrase(prompt string) (string, error) {
+	t, err := openTTY()
+	if err != nil {
+		return "", errors.New("no terminal to read the keyring passphrase from, set ASSUME_ROLE_PASSPHRASE")
+	}
+	defer t.Close()
+
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = t.In
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(t.Out)
+		}()
+	}
+
+	fmt.Fprint(t.Out, prompt)
+	text, err := bufio.NewReader(t.In).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(text, "\r\n"), nil
+}
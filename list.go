@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// listEntry describes what assume-role does for one profile.
+type listEntry struct {
+	Profile       string
+	RoleARN       string `json:"RoleArn,omitempty"`
+	Account       string `json:",omitempty"`
+	SourceProfile string `json:",omitempty"`
+	MFASerial     string `json:",omitempty"`
+	Region        string `json:",omitempty"`
+
+	// CachedUntil is when cached credentials for the profile expire, if
+	// there are any.
+	CachedUntil *time.Time `json:",omitempty"`
+
+	// Error is why the profile can't be assumed, if it can't.
+	Error string `json:",omitempty"`
+}
+
+// roleAccount returns the account ID in a role ARN.
+func roleAccount(arn string) string {
+	if m := roleArnRe.FindStringSubmatch(arn); m != nil {
+		return m[2]
+	}
+	return ""
+}
+
+// cachedUntil returns the expiration of the credentials cached under key, or
+// nil if there are none.
+func cachedUntil(cache *credentialCache, key string) (*time.Time, error) {
+	if cache == nil {
+		return nil, nil
+	}
+	creds, err := cache.Get(key)
+	if err != nil || creds == nil {
+		return nil, err
+	}
+	return &creds.Expiration, nil
+}
+
+// listProfiles returns an entry for every profile in the AWS CLI config and
+// credentials files and in the legacy roles file.
+func listProfiles(opts *options) ([]*listEntry, error) {
+	var entries []*listEntry
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prof := profiles[name]
+		entry := &listEntry{
+			Profile:       prof.Name,
+			RoleARN:       prof.RoleARN,
+			Account:       roleAccount(prof.RoleARN),
+			SourceProfile: prof.SourceProfile,
+			MFASerial:     prof.MFASerial,
+			Region:        prof.Region,
+		}
+		if prof.CredentialSource != "" {
+			entry.SourceProfile = prof.CredentialSource
+		}
+		entries = append(entries, entry)
+
+		if prof.RoleARN == "" {
+			continue
+		}
+
+		chain, err := profiles.Chain(name)
+		if err != nil {
+			entry.Error = err.Error()
+			continue
+		}
+		policy, err := prof.Policy()
+		if err != nil {
+			entry.Error = err.Error()
+			continue
+		}
+		tags, err := prof.SessionTags()
+		if err != nil {
+			entry.Error = err.Error()
+			continue
+		}
+		if entry.CachedUntil, err = cachedUntil(opts.Cache, tags.CacheKey(policy.CacheKey(profileCacheKey(chain, chainSourceKey(chain), opts)))); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(configFilePath); err == nil {
+		config, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for name := range config {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			roleConfig := config[name]
+			entry := &listEntry{
+				Profile:   name,
+				RoleARN:   roleConfig.Role,
+				Account:   roleAccount(roleConfig.Role),
+				MFASerial: roleConfig.MFA,
+			}
+			entries = append(entries, entry)
+
+			policy, err := roleConfig.Policy()
+			if err != nil {
+				entry.Error = err.Error()
+				continue
+			}
+			tags, err := roleConfig.SessionTags()
+			if err != nil {
+				entry.Error = err.Error()
+				continue
+			}
+			if entry.CachedUntil, err = cachedUntil(opts.Cache, tags.CacheKey(policy.CacheKey(roleConfig.CacheKey(opts)))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// list implements `assume-role list`, which shows every profile that can be
+// assumed.
+func list(args []string, opts *options) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the profiles as JSON.")
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	entries, err := listProfiles(opts)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tROLE\tACCOUNT\tSOURCE\tMFA\tREGION\tCACHED")
+	for _, e := range entries {
+		cached := "-"
+		switch {
+		case e.Error != "":
+			cached = "error: " + e.Error
+		case e.CachedUntil != nil:
+			cached = "until " + e.CachedUntil.Local().Format("15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Profile, dash(e.RoleARN), dash(e.Account), dash(e.SourceProfile), dash(e.MFASerial), dash(e.Region), cached)
+	}
+	return w.Flush()
+}
+
+// dash returns s, or a dash if it is empty, for table cells.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -15,19 +17,29 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"gopkg.in/yaml.v2"
 )
 
 var (
-	configFilePath = fmt.Sprintf("%s/.aws/roles", os.Getenv("HOME"))
-	roleArnRe      = regexp.MustCompile(`^arn:aws:iam::(.+):role/([^/]+)(/.+)?$`)
+	configFilePath = rolesFilename()
+	cacheDirPath   = fmt.Sprintf("%s/.aws/assume-role/cache", homeDir())
+	roleArnRe      = regexp.MustCompile(`^arn:(aws[a-z-]*):iam::(.+):role/([^/]+)(/.+)?$`)
 )
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s <role> [<command> <args...>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <role>[:<scope>] [<command> <args...>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] serve [-addr <address>] <role>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] imds [-addr <address>] <role>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] saml [-assertion <file>|-idp-url <url>] [-role <arn>] [<command> <args...>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] console [-open] [-destination <path>] [-session-duration <duration>] <role>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] whoami [-json]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] list [-json]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s migrate [-source-profile <profile>] [-yes]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] doctor [-offline] [-strict]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s totp enroll <mfa_serial> [<secret>|<otpauth-uri>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s totp remove <mfa_serial>\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
@@ -54,65 +66,338 @@ func defaultFormat() string {
 
 func main() {
 	var (
-		duration = flag.Duration("duration", time.Hour, "The duration that the credentials will be valid for.")
-		format   = flag.String("format", defaultFormat(), "Format can be 'bash' or 'powershell'.")
+		duration     = flag.Duration("duration", 0, "The duration that the credentials will be valid for. Defaults to the profile's duration_seconds, or 1h.")
+		sessionName  = flag.String("session-name", "", "The role session name, which may be a template like '{{.User}}@{{.Host}}'. Overrides role_session_name.")
+		externalID   = flag.String("external-id", "", "The external ID to assume a role given as an ARN with.")
+		negotiate    = flag.Bool("negotiate-duration", false, "When a role doesn't allow the requested duration, retry with the longest one it allows, in whole hours when it requires MFA.")
+		format       = flag.String("format", defaultFormat(), "Format can be 'bash', 'fish', 'powershell', 'json' or 'credential-process'.")
+		noCache      = flag.Bool("no-cache", false, "Always request new credentials instead of reusing cached ones.")
+		expiryWindow = flag.Duration("expiry-window", 5*time.Minute, "How long before expiration cached credentials are refreshed.")
+		server       = flag.Bool("server", false, "Provide credentials to the command through a local credential server, refreshing them as needed.")
+		mfaSession   = flag.Bool("mfa-session", false, "Assume roles that require MFA from a cached MFA session, so that a code is only needed when it expires.")
+		mfaDuration  = flag.Duration("mfa-session-duration", 12*time.Hour, "The duration that MFA sessions will be valid for.")
+		mfaTimeout   = flag.Duration("mfa-process-timeout", time.Minute, "How long to wait for an mfa_process to print a code.")
+		endpoint     = flag.String("sts-endpoint", "", "Override the STS endpoint, e.g. for testing.")
+		configFile   = flag.String("config-file", "", "The AWS CLI config file. Defaults to $AWS_CONFIG_FILE or ~/.aws/config.")
+		credsFile    = flag.String("credentials-file", "", "The AWS CLI credentials file. Defaults to $AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.")
+		rolesFile    = flag.String("roles-file", "", "The deprecated roles file. Defaults to $ASSUME_ROLE_ROLES_FILE or ~/.aws/roles.")
+		policy       = flag.String("policy", "", "A session policy to scope down the role with, as JSON or the name of a file holding it. Overrides session_policy.")
+		policyARNs   stringsFlag
+		tags         stringsFlag
 	)
+	flag.Var(&policyARNs, "policy-arn", "A managed policy to scope down the role with, may be given more than once. Added to session_policy_arns.")
+	flag.Var(&tags, "tag", "A key=value session tag to assume the role with, may be given more than once. The value may be a template like '{{.User}}'.")
 	flag.Parse()
 	argv := flag.Args()
-	if len(argv) < 1 {
+	if len(argv) < 1 && !(isTerminal(os.Stdin) && isTerminal(os.Stderr)) {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	stscreds.DefaultDuration = *duration
+	home := homeDir()
+	if home == "" {
+		must(fmt.Errorf("can't determine your home directory, set HOME"))
+	}
+
+	// The SDK finds the AWS CLI files on its own when credentials come
+	// from the environment, so it is pointed at the same ones.
+	if os.Getenv("HOME") == "" {
+		os.Setenv("HOME", home)
+	}
+	if *configFile != "" {
+		os.Setenv("AWS_CONFIG_FILE", *configFile)
+	}
+	if *credsFile != "" {
+		os.Setenv("AWS_SHARED_CREDENTIALS_FILE", *credsFile)
+	}
+	if *rolesFile != "" {
+		configFilePath = *rolesFile
+	}
+
+	// When used as a credential_process stdin and stdout belong to the SDK
+	// that started us, so prompts must go to the terminal.
+	promptOnTTY = *format == "credential-process"
+
+	mfaProcessTimeout = *mfaTimeout
+	stsEndpoint = *endpoint
+
+	settings, err := loadSettings()
+	must(err)
+
+	sessionPolicy, err := parseSessionPolicy(*policy, policyARNs)
+	must(err)
+
+	sessionTags, err := parseTags(tags, nil)
+	must(err)
+
+	opts := &options{
+		Duration:           *duration,
+		NegotiateDuration:  *negotiate || settings.NegotiateDuration,
+		SessionName:        *sessionName,
+		ExternalID:         *externalID,
+		Window:             *expiryWindow,
+		Format:             *format,
+		MFASession:         *mfaSession || settings.MFASession,
+		MFASessionDuration: *mfaDuration,
+		MFAProcess:         settings.MFAProcess,
+		Policy:             sessionPolicy,
+		Scopes:             settings.Scopes,
+		Tags:               sessionTags,
+	}
+	if !*noCache {
+		store, err := openKeyring(settings.Keyring, cacheDirPath)
+		must(err)
+		if settings.Keyring == "encrypted-file" {
+			// Credentials cached by the file keyring would otherwise stay
+			// on disk in plaintext after switching. Unlike TOTP secrets,
+			// they can simply be requested again.
+			removeFiles(cacheDirPath, ".json")
+		}
+		opts.Cache = &credentialCache{Keyring: store, Window: *expiryWindow}
+	}
+
+	totpSecrets, err = openKeyring(settings.TOTPKeyring, totpDirPath)
+	must(err)
+
+	if len(argv) == 0 {
+		role, err := pickProfile()
+		must(err)
+		argv = []string{role}
+	} else {
+		switch argv[0] {
+		case "totp":
+			must(totp(argv[1:], totpSecrets))
+			return
+		case "serve":
+			must(serve(argv[1:], opts))
+			return
+		case "imds":
+			must(imds(argv[1:], opts))
+			return
+		case "saml":
+			must(saml(argv[1:], settings, opts))
+			return
+		case "console":
+			must(console(argv[1:], opts))
+			return
+		case "whoami":
+			must(whoami(argv[1:]))
+			return
+		case "list":
+			must(list(argv[1:], opts))
+			return
+		case "migrate":
+			must(migrate(argv[1:]))
+			return
+		case "doctor":
+			must(doctorCommand(argv[1:]))
+			return
+		}
+	}
 
 	role := argv[0]
 	args := argv[1:]
 
-	// Load credentials from configFilePath if it exists, else use regular AWS config
-	var creds *credentials.Value
-	var err error
+	if len(args) > 0 && *server {
+		err := execWithServer(role, args, opts.refreshing(role))
+		must(err)
+		return
+	}
+
+	creds, err := retrieveCredentials(role, opts)
+	must(err)
+	recordRecent(role)
+
+	err = useCredentials(role, args, creds, opts)
+	must(err)
+}
+
+// useCredentials prints creds in the configured format when there is no
+// command in argv, else it runs the command with them.
+func useCredentials(role string, argv []string, creds *tempCredentials, opts *options) error {
+	if len(argv) > 0 {
+		return execWithCredentials(role, argv, creds)
+	}
+
+	switch opts.Format {
+	case "powershell":
+		printPowerShellCredentials(role, creds)
+	case "bash":
+		printCredentials(role, creds)
+	case "fish":
+		printFishCredentials(role, creds)
+	case "json":
+		return printJSONCredentials(role, creds)
+	case "credential-process":
+		return printCredentialProcess(creds)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	return nil
+}
+
+// options are the settings shared by every command.
+type options struct {
+	// Duration is how long assumed role credentials are valid for. When
+	// zero, the duration configured for the role is used.
+	Duration time.Duration
+
+	// NegotiateDuration enables retrying with the longest duration a role
+	// allows when it doesn't allow the requested one.
+	NegotiateDuration bool
+
+	// SessionName, when set, is the role session name template used for
+	// every role instead of the configured one.
+	SessionName string
+
+	// ExternalID is the external ID to assume roles given as ARNs with.
+	ExternalID string
+
+	// Policy, when set, is the session policy that the role being asked
+	// for is assumed with instead of the configured one. Roles it is
+	// assumed from keep theirs.
+	Policy sessionPolicy
+
+	// Scopes are the named session policies that can be appended to a
+	// role.
+	Scopes map[string]scopeSettings
+
+	// Tags are session tags that the role being asked for is assumed with
+	// in addition to its configured ones.
+	Tags sessionTags
+
+	// Window is how long before expiration credentials are refreshed.
+	Window time.Duration
+
+	// Format is the shell that output is formatted for.
+	Format string
+
+	// MFASession enables assuming roles that require MFA from an MFA
+	// authenticated session, which is valid for MFASessionDuration.
+	MFASession         bool
+	MFASessionDuration time.Duration
+
+	// MFAProcess is the default command that prints MFA codes.
+	MFAProcess string
+
+	// Cache, when set, is consulted before requesting credentials from STS.
+	Cache *credentialCache
+}
+
+// defaultDuration is how long assumed role credentials are valid for when no
+// duration is configured.
+const defaultDuration = time.Hour
+
+// duration returns how long to assume a role for: the -duration flag if given,
+// else configured, the role's duration_seconds, if it has one, else
+// defaultDuration.
+func (o *options) duration(configured time.Duration) time.Duration {
+	switch {
+	case o.Duration > 0:
+		return o.Duration
+	case configured > 0:
+		return configured
+	default:
+		return defaultDuration
+	}
+}
+
+// sessionName returns the role session name template to assume a role with:
+// the -session-name flag if given, else configured, the role's
+// role_session_name, if it has one, else defaultRoleSessionName.
+func (o *options) sessionName(configured string) string {
+	switch {
+	case o.SessionName != "":
+		return o.SessionName
+	case configured != "":
+		return configured
+	default:
+		return defaultRoleSessionName
+	}
+}
+
+// refreshing returns credentials for role that are retrieved again whenever
+// they are about to expire.
+func (o *options) refreshing(role string) *refreshingCredentials {
+	return &refreshingCredentials{
+		Retrieve: func() (*tempCredentials, error) {
+			return retrieveCredentials(role, o)
+		},
+		Window: o.Window,
+	}
+}
+
+// retrieveCredentials returns temporary credentials for role, which is either a
+// role ARN, an entry in the deprecated roles file or a profile in
+// ~/.aws/config, optionally followed by :scope.
+func retrieveCredentials(role string, opts *options) (*tempCredentials, error) {
+	role, opts, err := opts.scope(role)
+	if err != nil {
+		return nil, err
+	}
+
 	if roleArnRe.MatchString(role) {
-		creds, err = assumeRole(role, "", *duration)
-	} else if _, err = os.Stat(configFilePath); err == nil {
+		return opts.Cache.Fetch(opts.Tags.CacheKey(opts.Policy.CacheKey(cacheKey(role, "", opts.ExternalID, defaultAccessKeyID(), opts.sessionName(""), opts.duration(0).String()))), func() (*tempCredentials, error) {
+			return assumeRoleFrom(nil, "", &roleInput{
+				RoleARN:    role,
+				ExternalID: opts.ExternalID,
+				Policy:     opts.Policy,
+				Tags:       opts.Tags,
+				Profile:    role,
+			}, opts)
+		})
+	}
+
+	// Load credentials from configFilePath if it exists, else use regular AWS config
+	if _, err := os.Stat(configFilePath); err == nil {
 		fmt.Fprintf(os.Stderr, "WARNING: using deprecated role file (%s), switch to config file"+
-			" (https://docs.aws.amazon.com/cli/latest/userguide/cli-roles.html)\n",
+			" (https://docs.aws.amazon.com/cli/latest/userguide/cli-roles.html) with `assume-role migrate`\n",
 			configFilePath)
 		config, err := loadConfig()
-		must(err)
+		if err != nil {
+			return nil, err
+		}
 
 		roleConfig, ok := config[role]
 		if !ok {
-			must(fmt.Errorf("%s not in %s", role, configFilePath))
+			return nil, fmt.Errorf("%s not in %s", role, configFilePath)
 		}
 
-		creds, err = assumeRole(roleConfig.Role, roleConfig.MFA, *duration)
-	} else {
-		creds, err = assumeProfile(role)
-	}
-
-	must(err)
+		policy, err := roleConfig.Policy()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", role, err)
+		}
+		policy, err = opts.policy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", role, err)
+		}
 
-	if len(args) == 0 {
-		switch *format {
-		case "powershell":
-			printPowerShellCredentials(role, creds)
-		case "bash":
-			printCredentials(role, creds)
-		case "fish":
-			printFishCredentials(role, creds)
-		default:
-			flag.Usage()
-			os.Exit(1)
+		tags, err := roleConfig.SessionTags()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", role, err)
 		}
-		return
+		tags = opts.tags(tags)
+
+		return opts.Cache.Fetch(tags.CacheKey(policy.CacheKey(roleConfig.CacheKey(opts))), func() (*tempCredentials, error) {
+			return assumeRoleFrom(nil, "", &roleInput{
+				RoleARN:     roleConfig.Role,
+				MFASerial:   roleConfig.MFA,
+				MFAProcess:  roleConfig.MFAProcess,
+				ExternalID:  roleConfig.ExternalID,
+				Duration:    time.Duration(roleConfig.DurationSeconds) * time.Second,
+				SessionName: roleConfig.RoleSessionName,
+				Policy:      policy,
+				Tags:        tags,
+				Profile:     role,
+			}, opts)
+		})
 	}
 
-	err = execWithCredentials(role, args, creds)
-	must(err)
+	return assumeProfile(role, opts)
 }
 
-func execWithCredentials(role string, argv []string, creds *credentials.Value) error {
+func execWithCredentials(role string, argv []string, creds *tempCredentials) error {
 	argv0, err := exec.LookPath(argv[0])
 	if err != nil {
 		return err
@@ -123,6 +408,19 @@ func execWithCredentials(role string, argv []string, creds *credentials.Value) e
 	os.Setenv("AWS_SESSION_TOKEN", creds.SessionToken)
 	os.Setenv("AWS_SECURITY_TOKEN", creds.SessionToken)
 	os.Setenv("ASSUMED_ROLE", role)
+	if len(creds.Tags) > 0 {
+		os.Setenv("ASSUMED_ROLE_TAGS", creds.tagList())
+	} else {
+		os.Unsetenv("ASSUMED_ROLE_TAGS")
+	}
+	if !creds.Expiration.IsZero() {
+		os.Setenv("AWS_CREDENTIAL_EXPIRATION", formatExpiration(creds))
+		os.Setenv("ASSUMED_ROLE_EXPIRATION", formatExpiration(creds))
+	} else {
+		// Don't pass on the expiration of previously assumed credentials.
+		os.Unsetenv("AWS_CREDENTIAL_EXPIRATION")
+		os.Unsetenv("ASSUMED_ROLE_EXPIRATION")
+	}
 
 	env := os.Environ()
 	return syscall.Exec(argv0, argv, env)
@@ -130,71 +428,506 @@ func execWithCredentials(role string, argv []string, creds *credentials.Value) e
 
 // printCredentials prints the credentials in a way that can easily be sourced
 // with bash.
-func printCredentials(role string, creds *credentials.Value) {
+func printCredentials(role string, creds *tempCredentials) {
 	fmt.Printf("export AWS_ACCESS_KEY_ID=\"%s\"\n", creds.AccessKeyID)
 	fmt.Printf("export AWS_SECRET_ACCESS_KEY=\"%s\"\n", creds.SecretAccessKey)
 	fmt.Printf("export AWS_SESSION_TOKEN=\"%s\"\n", creds.SessionToken)
 	fmt.Printf("export AWS_SECURITY_TOKEN=\"%s\"\n", creds.SessionToken)
 	fmt.Printf("export ASSUMED_ROLE=\"%s\"\n", role)
+	if len(creds.Tags) > 0 {
+		fmt.Printf("export ASSUMED_ROLE_TAGS=\"%s\"\n", creds.tagList())
+	} else {
+		// Clear the tags of a previously assumed role.
+		fmt.Printf("unset ASSUMED_ROLE_TAGS\n")
+	}
+	if !creds.Expiration.IsZero() {
+		fmt.Printf("export AWS_CREDENTIAL_EXPIRATION=\"%s\"\n", formatExpiration(creds))
+		fmt.Printf("export ASSUMED_ROLE_EXPIRATION=\"%s\"\n", formatExpiration(creds))
+	} else {
+		// Clear the expiration of previously assumed credentials.
+		fmt.Printf("unset AWS_CREDENTIAL_EXPIRATION ASSUMED_ROLE_EXPIRATION\n")
+	}
 	fmt.Printf("# Run this to configure your shell:\n")
 	fmt.Printf("# eval $(%s)\n", strings.Join(os.Args, " "))
 }
 
 // printFishCredentials prints the credentials in a way that can easily be sourced
 // with fish.
-func printFishCredentials(role string, creds *credentials.Value) {
+func printFishCredentials(role string, creds *tempCredentials) {
 	fmt.Printf("set -gx AWS_ACCESS_KEY_ID \"%s\";\n", creds.AccessKeyID)
 	fmt.Printf("set -gx AWS_SECRET_ACCESS_KEY \"%s\";\n", creds.SecretAccessKey)
 	fmt.Printf("set -gx AWS_SESSION_TOKEN \"%s\";\n", creds.SessionToken)
 	fmt.Printf("set -gx AWS_SECURITY_TOKEN \"%s\";\n", creds.SessionToken)
 	fmt.Printf("set -gx ASSUMED_ROLE \"%s\";\n", role)
+	if len(creds.Tags) > 0 {
+		fmt.Printf("set -gx ASSUMED_ROLE_TAGS \"%s\";\n", creds.tagList())
+	} else {
+		fmt.Printf("set -e ASSUMED_ROLE_TAGS;\n")
+	}
+	if !creds.Expiration.IsZero() {
+		fmt.Printf("set -gx AWS_CREDENTIAL_EXPIRATION \"%s\";\n", formatExpiration(creds))
+		fmt.Printf("set -gx ASSUMED_ROLE_EXPIRATION \"%s\";\n", formatExpiration(creds))
+	} else {
+		fmt.Printf("set -e AWS_CREDENTIAL_EXPIRATION;\n")
+		fmt.Printf("set -e ASSUMED_ROLE_EXPIRATION;\n")
+	}
 	fmt.Printf("# Run this to configure your shell:\n")
 	fmt.Printf("# eval (%s)\n", strings.Join(os.Args, " "))
 }
 
 // printPowerShellCredentials prints the credentials in a way that can easily be sourced
 // with Windows powershell using Invoke-Expression.
-func printPowerShellCredentials(role string, creds *credentials.Value) {
+func printPowerShellCredentials(role string, creds *tempCredentials) {
 	fmt.Printf("$env:AWS_ACCESS_KEY_ID=\"%s\"\n", creds.AccessKeyID)
 	fmt.Printf("$env:AWS_SECRET_ACCESS_KEY=\"%s\"\n", creds.SecretAccessKey)
 	fmt.Printf("$env:AWS_SESSION_TOKEN=\"%s\"\n", creds.SessionToken)
 	fmt.Printf("$env:AWS_SECURITY_TOKEN=\"%s\"\n", creds.SessionToken)
 	fmt.Printf("$env:ASSUMED_ROLE=\"%s\"\n", role)
+	if len(creds.Tags) > 0 {
+		fmt.Printf("$env:ASSUMED_ROLE_TAGS=\"%s\"\n", creds.tagList())
+	} else {
+		fmt.Printf("Remove-Item Env:ASSUMED_ROLE_TAGS -ErrorAction SilentlyContinue\n")
+	}
+	if !creds.Expiration.IsZero() {
+		fmt.Printf("$env:AWS_CREDENTIAL_EXPIRATION=\"%s\"\n", formatExpiration(creds))
+		fmt.Printf("$env:ASSUMED_ROLE_EXPIRATION=\"%s\"\n", formatExpiration(creds))
+	} else {
+		fmt.Printf("Remove-Item Env:AWS_CREDENTIAL_EXPIRATION -ErrorAction SilentlyContinue\n")
+		fmt.Printf("Remove-Item Env:ASSUMED_ROLE_EXPIRATION -ErrorAction SilentlyContinue\n")
+	}
 	fmt.Printf("# Run this to configure your shell:\n")
 	fmt.Printf("# %s | Invoke-Expression \n", strings.Join(os.Args, " "))
 }
 
+// formatExpiration formats the expiration of creds as an ISO 8601 timestamp.
+func formatExpiration(creds *tempCredentials) string {
+	return creds.Expiration.UTC().Format(time.RFC3339)
+}
+
+// jsonOutput is the JSON document printed by the json format.
+type jsonOutput struct {
+	Role            string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time `json:",omitempty"`
+	AssumedRoleARN  string     `json:"AssumedRoleArn,omitempty"`
+	RoleSessionName string     `json:",omitempty"`
+	SourceProfile   string     `json:",omitempty"`
+	Region          string     `json:",omitempty"`
+
+	Tags              map[string]string `json:",omitempty"`
+	TransitiveTagKeys []string          `json:",omitempty"`
+}
+
+// printJSONCredentials prints the credentials and details about the assumed
+// role as JSON, for consumption by other programs.
+func printJSONCredentials(role string, creds *tempCredentials) error {
+	out := &jsonOutput{
+		Role:              role,
+		AccessKeyID:       creds.AccessKeyID,
+		SecretAccessKey:   creds.SecretAccessKey,
+		SessionToken:      creds.SessionToken,
+		AssumedRoleARN:    creds.AssumedRoleARN,
+		RoleSessionName:   creds.RoleSessionName,
+		SourceProfile:     creds.SourceProfile,
+		Region:            creds.Region,
+		Tags:              creds.Tags,
+		TransitiveTagKeys: creds.TransitiveTagKeys,
+	}
+	if !creds.Expiration.IsZero() {
+		expiration := creds.Expiration.UTC()
+		out.Expiration = &expiration
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// credentialProcessOutput is the JSON document that a credential_process must
+// print (https://docs.aws.amazon.com/cli/latest/topic/config-vars.html#sourcing-credentials-from-external-processes).
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time `json:",omitempty"`
+}
+
+// printCredentialProcess prints the credentials in a way that can be used as
+// a credential_process in ~/.aws/config.
+func printCredentialProcess(creds *tempCredentials) error {
+	out := &credentialProcessOutput{
+		Version:         1,
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}
+	if !creds.Expiration.IsZero() {
+		expiration := creds.Expiration.UTC()
+		out.Expiration = &expiration
+	}
+	return json.NewEncoder(os.Stdout).Encode(out)
+}
+
+// printEnv prints environment variable assignments in a way that can easily be
+// sourced with the given shell.
+func printEnv(format string, vars [][2]string) {
+	for _, kv := range vars {
+		switch format {
+		case "powershell":
+			fmt.Printf("$env:%s=\"%s\"\n", kv[0], kv[1])
+		case "fish":
+			fmt.Printf("set -gx %s \"%s\";\n", kv[0], kv[1])
+		default:
+			fmt.Printf("export %s=\"%s\"\n", kv[0], kv[1])
+		}
+	}
+}
+
 // assumeProfile assumes the named profile which must exist in ~/.aws/config
 // (https://docs.aws.amazon.com/cli/latest/userguide/cli-roles.html) and returns the temporary STS
 // credentials.
-func assumeProfile(profile string) (*credentials.Value, error) {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Profile:                 profile,
-		SharedConfigState:       session.SharedConfigEnable,
-		AssumeRoleTokenProvider: readTokenCode,
-	}))
-
-	creds, err := sess.Config.Credentials.Get()
+//
+// Chains of source_profile are followed to any depth, caching the credentials
+// for every hop. MFA is only prompted for at the first hop that requires it,
+// as sessions assumed from it carry its MFA context.
+func assumeProfile(name string, opts *options) (*tempCredentials, error) {
+	profiles, err := loadProfiles()
 	if err != nil {
 		return nil, err
 	}
-	return &creds, nil
+
+	chain, err := profiles.Chain(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		creds  *tempCredentials
+		region string
+		mfa    bool // whether an earlier hop was authenticated with MFA
+	)
+
+	// hopPolicy and hopTags return the session policy and tags of the
+	// i-th profile in chain.
+	hopPolicy := func(i int) (sessionPolicy, error) {
+		policy, err := chain[i].Policy()
+		if err != nil || i < len(chain)-1 {
+			return policy, err
+		}
+		return opts.policy(policy)
+	}
+	hopTags := func(i int) (sessionTags, error) {
+		tags, err := chain[i].SessionTags()
+		if err != nil || i < len(chain)-1 {
+			return tags, err
+		}
+		return opts.tags(tags), nil
+	}
+
+	switch base := chain[0]; {
+	case base.HasWebIdentity():
+		policy, err := hopPolicy(0)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := hopTags(0)
+		if err != nil {
+			return nil, err
+		}
+		if !tags.IsZero() {
+			// The session's tags come from the token instead.
+			return nil, fmt.Errorf("%s: session tags can't be set for a web identity role", base.Name)
+		}
+
+		// The token is read again whenever the cached credentials
+		// expire, as token files are rotated by whatever issues them.
+		creds, err = opts.Cache.Fetch(policy.CacheKey(profileCacheKey(chain[:1], "", opts)), func() (*tempCredentials, error) {
+			duration, err := base.Duration()
+			if err != nil {
+				return nil, err
+			}
+			return assumeRoleWithWebIdentity(base, opts.duration(duration), opts.sessionName(base.RoleSessionName), policy)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", base.Name, err)
+		}
+	case base.HasKeys():
+		creds = &tempCredentials{Value: credentials.Value{
+			AccessKeyID:     base.AccessKeyID,
+			SecretAccessKey: base.SecretAccessKey,
+			SessionToken:    base.SessionToken,
+			ProviderName:    credentials.StaticProviderName,
+		}}
+	}
+
+	sourceKey := chainSourceKey(chain)
+
+	for i, hop := range chain {
+		if hop.Region != "" {
+			region = hop.Region
+		}
+		if i == 0 {
+			continue
+		}
+
+		source, sourceProfile := creds, chain[i-1].Name
+		mfaSerial := hop.MFASerial
+		if mfa {
+			mfaSerial = ""
+		}
+
+		policy, err := hopPolicy(i)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := hopTags(i)
+		if err != nil {
+			return nil, err
+		}
+
+		creds, err = opts.Cache.Fetch(tags.CacheKey(policy.CacheKey(profileCacheKey(chain[:i+1], sourceKey, opts))), func() (*tempCredentials, error) {
+			duration, err := hop.Duration()
+			if err != nil {
+				return nil, err
+			}
+			creds, err := assumeRoleFrom(source, region, &roleInput{
+				RoleARN:     hop.RoleARN,
+				MFASerial:   mfaSerial,
+				MFAProcess:  hop.MFAProcess,
+				ExternalID:  hop.ExternalID,
+				Duration:    duration,
+				SessionName: hop.RoleSessionName,
+				Policy:      policy,
+				Tags:        tags,
+				Profile:     hop.Name,
+			}, opts)
+			if err != nil {
+				return nil, err
+			}
+			creds.SourceProfile = sourceProfile
+			return creds, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", hop.Name, err)
+		}
+
+		if hop.MFASerial != "" {
+			mfa = true
+		}
+	}
+
+	creds.Region = region
+	return creds, nil
 }
 
-// assumeRole assumes the given role and returns the temporary STS credentials.
-func assumeRole(role, mfa string, duration time.Duration) (*credentials.Value, error) {
-	sess := session.Must(session.NewSession())
+// stsEndpoint overrides the endpoint of every STS request when set.
+var stsEndpoint string
 
+// profileCacheKey returns the key that credentials for the last profile in
+// chain are cached under, when the first profile's credentials have the access
+// key ID sourceKey. Every profile in the chain is part of the key, so that
+// changing any of them requests new credentials.
+func profileCacheKey(chain []*profile, sourceKey string, opts *options) string {
+	last := chain[len(chain)-1]
+	sessionName := opts.sessionName(last.RoleSessionName)
+
+	// An invalid duration_seconds is reported when the profile is assumed.
+	configured, _ := last.Duration()
+	duration := opts.duration(configured).String()
+
+	parts := []string{"profile", sourceKey}
+	if len(chain) == 1 {
+		// Only a web identity profile is assumed without a source.
+		parts[0] = "web-identity"
+	}
+	for _, hop := range chain {
+		parts = append(parts, hop.Name, hop.RoleARN, hop.ExternalID, hop.SourceProfile)
+	}
+
+	// MFA is only used by the first hop that requires it, so the same
+	// profile is cached separately with and without it.
+	mfaSerial := last.MFASerial
+	for _, hop := range chain[1 : len(chain)-1] {
+		if hop.MFASerial != "" {
+			mfaSerial = ""
+		}
+	}
+	return cacheKey(append(parts, mfaSerial, sessionName, duration)...)
+}
+
+// chainSourceKey returns the access key ID of the credentials that the first
+// profile in chain provides, which for a credential_source are whoever the
+// default credential chain resolves to. It is empty for a web identity.
+func chainSourceKey(chain []*profile) string {
+	switch base := chain[0]; {
+	case base.HasWebIdentity():
+		return ""
+	case base.HasKeys():
+		return base.AccessKeyID
+	default:
+		return defaultAccessKeyID()
+	}
+}
+
+// defaultAccessKeyID returns the access key ID of the default credential
+// chain, so that roles assumed with it are cached separately for every
+// identity. It is empty when there are no default credentials, in which case
+// assuming a role with them fails anyway.
+func defaultAccessKeyID() string {
+	value, err := newSession(nil, "").Config.Credentials.Get()
+	if err != nil {
+		return ""
+	}
+	return value.AccessKeyID
+}
+
+// newSession returns a session that uses creds, or the default credential
+// chain when creds is nil.
+func newSession(creds *tempCredentials, region string) *session.Session {
+	config := aws.NewConfig()
+	if endpoint := stsEndpointFor(region); endpoint != "" {
+		config.WithEndpoint(endpoint)
+	}
+	if creds != nil {
+		config.WithCredentials(credentials.NewStaticCredentialsFromCreds(creds.Value))
+	}
+	if region != "" {
+		config.WithRegion(region)
+	}
+	return session.Must(session.NewSession(config))
+}
+
+// roleInput describes a role to assume.
+type roleInput struct {
+	RoleARN string
+
+	// MFASerial is the MFA device required to assume the role, if any.
+	MFASerial string
+
+	// MFAProcess is a command that prints the MFA code. When empty the code
+	// is generated or prompted for.
+	MFAProcess string
+
+	// ExternalID is the external ID the role requires, if any.
+	ExternalID string
+
+	// Duration is how long the role is configured to be assumed for, if
+	// at all.
+	Duration time.Duration
+
+	// SessionName is the role_session_name template the role is
+	// configured with, if any. assumeRoleFrom renders it.
+	SessionName string
+
+	// Policy scopes down the role's permissions, unless it is zero.
+	Policy sessionPolicy
+
+	// Tags are the session tags the role is assumed with, whose values are
+	// templates. assumeRoleFrom renders them.
+	Tags sessionTags
+
+	// Profile is the name of the profile or role being assumed.
+	Profile string
+
+	// tokenCode is the MFA code once it has been read, so that retries
+	// don't ask for another one.
+	tokenCode string
+}
+
+// TokenCode returns a code for the role's MFA device.
+func (in *roleInput) TokenCode() (string, error) {
+	if in.tokenCode != "" {
+		return in.tokenCode, nil
+	}
+
+	var err error
+	if in.MFAProcess != "" {
+		in.tokenCode, err = runMFAProcess(in.MFAProcess)
+	} else {
+		in.tokenCode, err = readTokenCode(in.MFASerial)
+	}
+	return in.tokenCode, err
+}
+
+// assumeRoleFrom assumes the given role using the source credentials, or the
+// default credentials when source is nil. When MFA sessions are enabled and
+// the role requires MFA, it is assumed from an MFA session of source instead.
+func assumeRoleFrom(source *tempCredentials, region string, in *roleInput, opts *options) (*tempCredentials, error) {
+	role := *in
+	if role.MFAProcess == "" {
+		role.MFAProcess = opts.MFAProcess
+	}
+	region = roleRegion(role.RoleARN, region)
+
+	sessionName, err := renderSessionName(opts.sessionName(role.SessionName), role.Profile)
+	if err != nil {
+		return nil, err
+	}
+	role.SessionName = sessionName
+
+	if role.Tags, err = role.Tags.render(role.Profile); err != nil {
+		return nil, err
+	}
+
+	// Transitive tags carry over from source, even when the role is
+	// assumed from an MFA session of it instead.
+	tagSource := source
+
+	if role.MFASerial != "" && opts.MFASession {
+		session, ok, err := mfaSession(source, region, &role, opts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			source, role.MFASerial = session, ""
+		}
+	}
+
+	duration := opts.duration(role.Duration)
+	if source != nil && source.AssumedRoleARN != "" && duration > maxChainedDuration {
+		// AWS limits sessions of roles assumed by other roles to an
+		// hour, and rejects longer durations.
+		duration = maxChainedDuration
+	}
+
+	role.Policy.warnSize()
+
+	sess := newSession(source, region)
+	creds, err := assumeRole(sess, &role, duration)
+	if opts.NegotiateDuration && isDurationError(err) {
+		creds, err = assumeRoleWithLongestDuration(sess, &role, duration)
+	}
+	if err != nil {
+		return nil, err
+	}
+	creds.inheritTags(tagSource)
+	return creds, nil
+}
+
+// assumeRole assumes the given role using the credentials of sess and returns
+// the temporary STS credentials.
+func assumeRole(sess *session.Session, role *roleInput, duration time.Duration) (*tempCredentials, error) {
 	svc := sts.New(sess)
 
 	params := &sts.AssumeRoleInput{
-		RoleArn:         aws.String(role),
-		RoleSessionName: aws.String("cli"),
+		RoleArn:         aws.String(role.RoleARN),
+		RoleSessionName: aws.String(role.SessionName),
 		DurationSeconds: aws.Int64(int64(duration / time.Second)),
 	}
-	if mfa != "" {
-		params.SerialNumber = aws.String(mfa)
-		token, err := readTokenCode()
+	if role.ExternalID != "" {
+		params.ExternalId = aws.String(role.ExternalID)
+	}
+	if role.Policy.Document != "" {
+		params.Policy = aws.String(role.Policy.Document)
+	}
+	params.PolicyArns = role.Policy.policyARNs()
+	params.Tags, params.TransitiveTagKeys = role.Tags.stsTags()
+	if role.MFASerial != "" {
+		params.SerialNumber = aws.String(role.MFASerial)
+		token, err := role.TokenCode()
 		if err != nil {
 			return nil, err
 		}
@@ -206,26 +939,87 @@ func assumeRole(role, mfa string, duration time.Duration) (*credentials.Value, e
 	if err != nil {
 		return nil, err
 	}
+	warnPackedPolicySize(resp.PackedPolicySize)
 
-	var creds credentials.Value
+	var creds tempCredentials
 	creds.AccessKeyID = *resp.Credentials.AccessKeyId
 	creds.SecretAccessKey = *resp.Credentials.SecretAccessKey
 	creds.SessionToken = *resp.Credentials.SessionToken
+	creds.Expiration = *resp.Credentials.Expiration
+	creds.AssumedRoleARN = *resp.AssumedRoleUser.Arn
+	creds.RoleSessionName = role.SessionName
+	creds.Region = aws.StringValue(sess.Config.Region)
+	if !role.Tags.IsZero() {
+		creds.Tags = role.Tags.Tags
+		creds.TransitiveTagKeys = role.Tags.Transitive
+	}
 
 	return &creds, nil
 }
 
 type roleConfig struct {
-	Role string `yaml:"role"`
-	MFA  string `yaml:"mfa"`
+	Role            string `yaml:"role"`
+	MFA             string `yaml:"mfa"`
+	MFAProcess      string `yaml:"mfa_process"`
+	ExternalID      string `yaml:"external_id"`
+	DurationSeconds int    `yaml:"duration_seconds"`
+	RoleSessionName string `yaml:"role_session_name"`
+
+	SessionPolicy     string   `yaml:"session_policy"`
+	SessionPolicyARNs []string `yaml:"session_policy_arns"`
+
+	Tags           map[string]string `yaml:"tags"`
+	TransitiveTags []string          `yaml:"transitive_tags"`
+}
+
+// Policy returns the role's session policy.
+func (r roleConfig) Policy() (sessionPolicy, error) {
+	return parseSessionPolicy(r.SessionPolicy, r.SessionPolicyARNs)
+}
+
+// SessionTags returns the role's session tags.
+func (r roleConfig) SessionTags() (sessionTags, error) {
+	t := sessionTags{Tags: r.Tags, Transitive: r.TransitiveTags}
+	return t, t.Validate()
+}
+
+// CacheKey returns the key that credentials for the role are cached under.
+func (r roleConfig) CacheKey(opts *options) string {
+	duration := opts.duration(time.Duration(r.DurationSeconds) * time.Second)
+	return cacheKey(r.Role, r.MFA, r.ExternalID, defaultAccessKeyID(), opts.sessionName(r.RoleSessionName), duration.String())
 }
 
 type config map[string]roleConfig
 
-// readTokenCode reads the MFA token from Stdin.
-func readTokenCode() (string, error) {
-	r := bufio.NewReader(os.Stdin)
-	fmt.Fprintf(os.Stderr, "MFA code: ")
+// promptOnTTY makes readTokenCode use the controlling terminal instead of
+// Stdin and Stderr.
+var promptOnTTY bool
+
+// readTokenCode returns an MFA code for the device mfa. It is generated when a
+// TOTP secret is enrolled for the device, else it is read from Stdin.
+func readTokenCode(mfa string) (string, error) {
+	if totpSecrets != nil {
+		code, ok, err := generateTOTP(totpSecrets, mfa)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return code, nil
+		}
+	}
+
+	in, out := io.Reader(os.Stdin), io.Writer(os.Stderr)
+	if promptOnTTY {
+		t, err := openTTY()
+		if err != nil {
+			return "", fmt.Errorf("no terminal to read the MFA code from: %v", err)
+		}
+		defer t.Close()
+		in, out = t.In, t.Out
+	}
+
+	r := bufio.NewReader(in)
+	fmt.Fprintf(out, "MFA code: ")
 	text, err := r.ReadString('\n')
 	if err != nil {
 		return "", err
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// mfaSession returns credentials for an MFA authenticated session of the IAM
+// user that owns source, or the default credentials when source is nil, using
+// the MFA device of role. The session is cached for its whole lifetime, so
+// that any number of roles that require MFA can be assumed from it with a
+// single code.
+//
+// ok is false when source are themselves temporary credentials, which can't
+// be used to get a session token.
+func mfaSession(source *tempCredentials, region string, role *roleInput, opts *options) (creds *tempCredentials, ok bool, err error) {
+	sess := newSession(source, region)
+
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, false, err
+	}
+	if value.SessionToken != "" {
+		return nil, false, nil
+	}
+
+	// The session is keyed by the access key it belongs to, so every
+	// profile that shares a source reuses it.
+	creds, err = opts.Cache.Fetch(cacheKey("mfa-session", value.AccessKeyID, role.MFASerial), func() (*tempCredentials, error) {
+		token, err := role.TokenCode()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := sts.New(sess).GetSessionToken(&sts.GetSessionTokenInput{
+			DurationSeconds: aws.Int64(int64(opts.MFASessionDuration / time.Second)),
+			SerialNumber:    aws.String(role.MFASerial),
+			TokenCode:       aws.String(token),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var creds tempCredentials
+		creds.AccessKeyID = *resp.Credentials.AccessKeyId
+		creds.SecretAccessKey = *resp.Credentials.SecretAccessKey
+		creds.SessionToken = *resp.Credentials.SessionToken
+		creds.Expiration = *resp.Credentials.Expiration
+		return &creds, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return creds, true, nil
+}
+
+// mfaProcessTimeout is how long runMFAProcess waits for a code.
+var mfaProcessTimeout = time.Minute
+
+// mfaCodeRe matches a valid MFA code.
+var mfaCodeRe = regexp.MustCompile(`^[0-9]{6}$`)
+
+// runMFAProcess runs the shell command configured as an mfa_process and
+// returns the MFA code it prints.
+func runMFAProcess(command string) (string, error) {
+	code, err := runProcess("mfa_process", command, mfaProcessTimeout)
+	if err != nil {
+		return "", err
+	}
+	if !mfaCodeRe.MatchString(code) {
+		return "", fmt.Errorf("mfa_process %q did not print a 6 digit MFA code", command)
+	}
+	return code, nil
+}
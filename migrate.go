@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// migrationSections returns [profile x] sections for the roles in config that
+// aren't already in existing, sourcing their credentials from
+// sourceProfile, along with the names of the roles that were skipped.
+func migrationSections(config config, existing *ini.File, sourceProfile string) (string, []string) {
+	var names []string
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		buf     bytes.Buffer
+		skipped []string
+	)
+	for _, name := range names {
+		section := migrationSection(name)
+		if _, err := existing.GetSection(section); err == nil {
+			skipped = append(skipped, name)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\n[%s]\n", section)
+		settings := migratedSettings(config[name], sourceProfile)
+		for _, key := range migratedKeys {
+			if value, ok := settings[key]; ok {
+				fmt.Fprintf(&buf, "%s = %s\n", key, value)
+			}
+		}
+	}
+	if buf.Len() == 0 {
+		return "", skipped
+	}
+	return fmt.Sprintf("\n# Migrated from %s by assume-role migrate.\n", configFilePath) + buf.String()[1:], skipped
+}
+
+// migrationSection returns the name of the config file section that the role
+// name is migrated to.
+func migrationSection(name string) string {
+	if name == "default" {
+		return name
+	}
+	return "profile " + name
+}
+
+// migratedKeys are the profile settings that roles are migrated to, in the
+// order they are written.
+var migratedKeys = []string{
+	"role_arn",
+	"source_profile",
+	"mfa_serial",
+	"mfa_process",
+	"external_id",
+	"duration_seconds",
+	"role_session_name",
+	"session_policy",
+	"session_policy_arns",
+	"tags",
+	"transitive_tags",
+}
+
+// migratedSettings returns the profile settings that the role r is migrated
+// to, by key.
+func migratedSettings(r roleConfig, sourceProfile string) map[string]string {
+	settings := map[string]string{
+		"role_arn":       r.Role,
+		"source_profile": sourceProfile,
+	}
+	if r.MFA != "" {
+		settings["mfa_serial"] = r.MFA
+	}
+	if r.MFAProcess != "" {
+		settings["mfa_process"] = r.MFAProcess
+	}
+	if r.ExternalID != "" {
+		settings["external_id"] = r.ExternalID
+	}
+	if r.DurationSeconds > 0 {
+		settings["duration_seconds"] = strconv.Itoa(r.DurationSeconds)
+	}
+	if r.RoleSessionName != "" {
+		settings["role_session_name"] = r.RoleSessionName
+	}
+	if r.SessionPolicy != "" {
+		// Values in the config file are a single line.
+		policy := r.SessionPolicy
+		var compact bytes.Buffer
+		if json.Compact(&compact, []byte(policy)) == nil {
+			policy = compact.String()
+		}
+		settings["session_policy"] = policy
+	}
+	if len(r.SessionPolicyARNs) > 0 {
+		settings["session_policy_arns"] = strings.Join(r.SessionPolicyARNs, ",")
+	}
+	if len(r.Tags) > 0 {
+		settings["tags"] = sessionTags{Tags: r.Tags}.String()
+	}
+	if len(r.TransitiveTags) > 0 {
+		settings["transitive_tags"] = strings.Join(r.TransitiveTags, ",")
+	}
+	return settings
+}
+
+// migrationDifferences describes how the existing profile that the role name
+// was skipped for differs from what the role r would have been migrated to.
+func migrationDifferences(name string, r roleConfig, existing *ini.File, sourceProfile string) []string {
+	section, err := existing.GetSection(migrationSection(name))
+	if err != nil {
+		return nil
+	}
+
+	settings := migratedSettings(r, sourceProfile)
+	var diffs []string
+	for _, key := range migratedKeys {
+		want, got := settings[key], section.Key(key).String()
+		if want != got {
+			diffs = append(diffs, fmt.Sprintf("%s is %q in the roles file but %q in the profile", key, want, got))
+		}
+	}
+	return diffs
+}
+
+// printAppendDiff prints a unified diff of appending added to a file whose
+// contents were old.
+func printAppendDiff(name string, old []byte, added string) {
+	n := bytes.Count(old, []byte("\n"))
+	if len(old) > 0 && !bytes.HasSuffix(old, []byte("\n")) {
+		n++
+	}
+	lines := strings.Split(strings.TrimSuffix(added, "\n"), "\n")
+
+	fmt.Printf("--- %s\n+++ %s\n", name, name)
+	fmt.Printf("@@ -%d,0 +%d,%d @@\n", n, n+1, len(lines))
+	for _, line := range lines {
+		fmt.Printf("+%s\n", line)
+	}
+}
+
+// backupPath returns a timestamped name to back up the file at path to.
+func backupPath(path string) string {
+	return fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102150405"))
+}
+
+// confirm asks a yes or no question on the terminal.
+func confirm(question string) (bool, error) {
+	if !isTerminal(os.Stdin) {
+		return false, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	text, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	answer := strings.ToLower(strings.TrimSpace(text))
+	return answer == "y" || answer == "yes", nil
+}
+
+// migrate implements `assume-role migrate`, which moves the roles in the
+// deprecated roles file to profiles in the AWS CLI config file.
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var (
+		sourceProfile = fs.String("source-profile", "default", "The profile with the credentials that assume the migrated roles.")
+		yes           = fs.Bool("yes", false, "Write the changes without asking.")
+	)
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	config, err := loadConfig()
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s does not exist, there is nothing to migrate", configFilePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	configPath := sharedConfigFilename()
+	old, err := ioutil.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existing, err := ini.Load(old)
+	if err != nil {
+		return fmt.Errorf("%s: %v", configPath, err)
+	}
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, ok := profiles[*sourceProfile]; !ok {
+		fmt.Fprintf(os.Stderr, "WARNING: source profile %s does not exist yet, add it before using the migrated profiles\n", *sourceProfile)
+	}
+
+	added, skipped := migrationSections(config, existing, *sourceProfile)
+
+	// Once the roles file is retired, skipped roles are assumed with the
+	// existing profiles instead, which may not be the same roles at all.
+	var conflicting bool
+	for _, name := range skipped {
+		diffs := migrationDifferences(name, config[name], existing, *sourceProfile)
+		if len(diffs) == 0 {
+			fmt.Fprintf(os.Stderr, "Skipping %s, which is already the same profile in %s\n", name, configPath)
+			continue
+		}
+		conflicting = true
+		fmt.Fprintf(os.Stderr, "Skipping %s, which is already a different profile in %s:\n", name, configPath)
+		for _, diff := range diffs {
+			fmt.Fprintf(os.Stderr, "  %s\n", diff)
+		}
+	}
+
+	if added != "" {
+		printAppendDiff(configPath, old, added)
+	}
+
+	if !*yes {
+		ok, err := confirm(fmt.Sprintf("Update %s and retire %s?", configPath, configFilePath))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("nothing was changed, run with -yes to write the changes")
+		}
+
+		if conflicting {
+			ok, err := confirm("The different profiles will be used instead of the skipped roles. Continue?")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("nothing was changed, reconcile the different profiles or run with -yes to use them")
+			}
+		}
+	}
+
+	if added != "" {
+		if err := writeMigratedConfig(configPath, old, added); err != nil {
+			return err
+		}
+	}
+
+	// The roles file takes precedence over the config file, so it must go
+	// for the migrated profiles to be used.
+	rolesBackup := backupPath(configFilePath)
+	if err := os.Rename(configFilePath, rolesBackup); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Moved %s to %s\n", configFilePath, rolesBackup)
+	return nil
+}
+
+// writeMigratedConfig backs up the config file and appends added to it.
+func writeMigratedConfig(path string, old []byte, added string) error {
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+
+		backup := backupPath(path)
+		if err := ioutil.WriteFile(backup, old, mode); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Backed up %s to %s\n", path, backup)
+	}
+
+	data := old
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(data, added...)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, mode)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// partition is an AWS partition, a group of regions that is isolated from
+// the others, with its own ARNs, endpoints and console.
+type partition struct {
+	ID string
+
+	// RegionPrefixes are the prefixes of the partition's region names.
+	RegionPrefixes []string
+
+	// Region is the region STS is called in when none of the partition's
+	// regions is configured.
+	Region string
+
+	// STSEndpoint is the STS endpoint for a region, as a format string. An
+	// empty STSEndpoint leaves the endpoint to the SDK.
+	STSEndpoint string
+
+	// ConsoleURL is the web console, and FederationURL the endpoint that
+	// signs in to it.
+	ConsoleURL    string
+	FederationURL string
+}
+
+// partitions are the known partitions. The first is the default for regions
+// and ARNs that match none of the others.
+var partitions = []*partition{
+	{
+		ID:            "aws",
+		Region:        "us-east-1",
+		ConsoleURL:    "https://console.aws.amazon.com",
+		FederationURL: "https://signin.aws.amazon.com/federation",
+	},
+	{
+		ID:             "aws-cn",
+		RegionPrefixes: []string{"cn-"},
+		Region:         "cn-north-1",
+		STSEndpoint:    "https://sts.%s.amazonaws.com.cn",
+		ConsoleURL:     "https://console.amazonaws.cn",
+		FederationURL:  "https://signin.amazonaws.cn/federation",
+	},
+	{
+		ID:             "aws-us-gov",
+		RegionPrefixes: []string{"us-gov-"},
+		Region:         "us-gov-west-1",
+		STSEndpoint:    "https://sts.%s.amazonaws.com",
+		ConsoleURL:     "https://console.amazonaws-us-gov.com",
+		FederationURL:  "https://signin.amazonaws-us-gov.com/federation",
+	},
+	{
+		ID:             "aws-iso",
+		RegionPrefixes: []string{"us-iso-"},
+		Region:         "us-iso-east-1",
+		STSEndpoint:    "https://sts.%s.c2s.ic.gov",
+		ConsoleURL:     "https://console.c2shome.ic.gov",
+		FederationURL:  "https://signin.c2shome.ic.gov/federation",
+	},
+	{
+		ID:             "aws-iso-b",
+		RegionPrefixes: []string{"us-isob-"},
+		Region:         "us-isob-east-1",
+		STSEndpoint:    "https://sts.%s.sc2s.sgov.gov",
+		ConsoleURL:     "https://console.sc2shome.sgov.gov",
+		FederationURL:  "https://signin.sc2shome.sgov.gov/federation",
+	},
+}
+
+// arnPartition returns the partition of an ARN.
+func arnPartition(arn string) *partition {
+	parts := strings.SplitN(arn, ":", 3)
+	if len(parts) == 3 && parts[0] == "arn" {
+		for _, p := range partitions {
+			if p.ID == parts[1] {
+				return p
+			}
+		}
+	}
+	return partitions[0]
+}
+
+// regionPartition returns the partition of a region.
+func regionPartition(region string) *partition {
+	for _, p := range partitions {
+		for _, prefix := range p.RegionPrefixes {
+			if strings.HasPrefix(region, prefix) {
+				return p
+			}
+		}
+	}
+	return partitions[0]
+}
+
+// roleRegion returns the region to call STS in to assume the role arn:
+// region, or else the region from the environment, if it is in the role's
+// partition, and otherwise the partition's default region. An empty region
+// leaves it to the SDK.
+func roleRegion(arn, region string) string {
+	p := arnPartition(arn)
+
+	configured := region
+	if configured == "" {
+		configured = os.Getenv("AWS_REGION")
+	}
+	if regionPartition(configured) != p {
+		return p.Region
+	}
+	return region
+}
+
+// stsEndpointFor returns the STS endpoint for region, or an empty string to
+// leave it to the SDK.
+func stsEndpointFor(region string) string {
+	if stsEndpoint != "" {
+		return stsEndpoint
+	}
+	if p := regionPartition(region); p.STSEndpoint != "" {
+		return fmt.Sprintf(p.STSEndpoint, region)
+	}
+	return ""
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var recentFilePath = fmt.Sprintf("%s/.aws/assume-role/recent", homeDir())
+
+// maxRecent is how many recently used profiles are remembered.
+const maxRecent = 20
+
+// pickerHeight is how many matching profiles the picker shows at once.
+const pickerHeight = 10
+
+var errNoProfileChosen = errors.New("no profile chosen")
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	// Other character devices, like /dev/null, aren't terminals.
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = f
+	return cmd.Run() == nil
+}
+
+// recentProfiles returns the recently used profiles, most recent first.
+func recentProfiles() []string {
+	raw, err := ioutil.ReadFile(recentFilePath)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(raw))
+}
+
+// recordRecent moves name to the front of the recently used profiles.
+// Failures are ignored, as the list is only a convenience.
+func recordRecent(name string) {
+	recent := []string{name}
+	for _, r := range recentProfiles() {
+		if r != name && len(recent) < maxRecent {
+			recent = append(recent, r)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(recentFilePath), 0700); err != nil {
+		return
+	}
+	ioutil.WriteFile(recentFilePath, []byte(strings.Join(recent, "\n")+"\n"), 0600)
+}
+
+// knownProfiles returns the names of the roles that can be assumed by name,
+// recently used ones first and the rest sorted. These are the roles file's
+// entries when it exists, as names are then only looked up there, and the
+// profiles in the AWS CLI config and credentials files otherwise.
+func knownProfiles() ([]string, error) {
+	known := make(map[string]bool)
+
+	if _, err := os.Stat(configFilePath); err == nil {
+		config, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		for name := range config {
+			known[name] = true
+		}
+	} else {
+		profiles, err := loadProfiles()
+		if err != nil {
+			return nil, err
+		}
+		for name := range profiles {
+			known[name] = true
+		}
+	}
+
+	var names []string
+	for _, name := range recentProfiles() {
+		if known[name] {
+			names = append(names, name)
+			delete(known, name)
+		}
+	}
+
+	var rest []string
+	for name := range known {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	return append(names, rest...), nil
+}
+
+// fuzzyMatch reports whether query matches s, case insensitively, and how
+// well: prefixes rank before substrings, which rank before matches of the
+// query's characters in order anywhere in s.
+func fuzzyMatch(query, s string) (rank int, ok bool) {
+	query, s = strings.ToLower(query), strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(s, query):
+		return 0, true
+	case strings.Contains(s, query):
+		return 1, true
+	}
+
+	rest := s
+	for _, c := range query {
+		i := strings.IndexRune(rest, c)
+		if i < 0 {
+			return 0, false
+		}
+		rest = rest[i+len(string(c)):]
+	}
+	return 2, true
+}
+
+// filterProfiles returns the names matching query, best matches first.
+func filterProfiles(names []string, query string) []string {
+	var matches [3][]string
+	for _, name := range names {
+		if rank, ok := fuzzyMatch(query, name); ok {
+			matches[rank] = append(matches[rank], name)
+		}
+	}
+	return append(append(matches[0], matches[1]...), matches[2]...)
+}
+
+// pickProfile asks which profile to use on the terminal, with a list that is
+// filtered as the user types.
+func pickProfile() (string, error) {
+	names, err := knownProfiles()
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no profiles found in %s", sharedConfigFilename())
+	}
+
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	state, err := stty("-g")
+	if err != nil {
+		// Without stty (e.g. on Windows) there is no raw mode.
+		return pickProfileByLine(names)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return pickProfileByLine(names)
+	}
+	defer stty(state)
+
+	p := &picker{names: names, matches: names}
+	return p.run()
+}
+
+// picker is the state of the interactive profile picker.
+type picker struct {
+	names   []string
+	query   string
+	matches []string
+	sel     int
+}
+
+func (p *picker) run() (string, error) {
+	w := os.Stderr
+	defer fmt.Fprint(w, "\r\033[J")
+
+	buf := make([]byte, 16)
+	for {
+		p.draw()
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		in := buf[:n]
+
+		switch {
+		case string(in) == "\x1b[A":
+			p.move(-1)
+		case string(in) == "\x1b[B":
+			p.move(1)
+		case len(in) > 1 && in[0] == '\x1b':
+			// Other escape sequences are ignored.
+		default:
+			for _, c := range string(in) {
+				switch c {
+				case 3, 27: // Ctrl-C, Esc
+					return "", errNoProfileChosen
+				case '\r', '\n':
+					if len(p.matches) == 0 {
+						continue
+					}
+					return p.matches[p.sel], nil
+				case 16: // Ctrl-P
+					p.move(-1)
+				case 14: // Ctrl-N
+					p.move(1)
+				case 127, 8: // Backspace
+					if r := []rune(p.query); len(r) > 0 {
+						p.filter(string(r[:len(r)-1]))
+					}
+				case 21: // Ctrl-U
+					p.filter("")
+				default:
+					if c >= ' ' {
+						p.filter(p.query + string(c))
+					}
+				}
+			}
+		}
+	}
+}
+
+func (p *picker) filter(query string) {
+	p.query = query
+	p.matches = filterProfiles(p.names, query)
+	p.sel = 0
+}
+
+func (p *picker) move(delta int) {
+	if sel := p.sel + delta; sel >= 0 && sel < len(p.matches) {
+		p.sel = sel
+	}
+}
+
+// draw renders the query and the matches around the selection below it,
+// leaving the cursor after the query. In raw mode lines must end in \r\n.
+func (p *picker) draw() {
+	w := os.Stderr
+	fmt.Fprint(w, "\r\033[J")
+
+	offset := 0
+	if p.sel >= pickerHeight {
+		offset = p.sel - pickerHeight + 1
+	}
+	shown := p.matches[offset:]
+	if len(shown) > pickerHeight {
+		shown = shown[:pickerHeight]
+	}
+
+	for i, name := range shown {
+		if offset+i == p.sel {
+			fmt.Fprintf(w, "\r\n\033[7m> %s\033[0m", name)
+		} else {
+			fmt.Fprintf(w, "\r\n  %s", name)
+		}
+	}
+	if len(shown) > 0 {
+		fmt.Fprintf(w, "\033[%dA", len(shown))
+	}
+	fmt.Fprintf(w, "\rProfile: %s", p.query)
+}
+
+// pickProfileByLine asks which profile to use on a terminal that can't be put
+// in raw mode. Entering text filters the list until one profile is left or a
+// number is entered.
+func pickProfileByLine(names []string) (string, error) {
+	r := bufio.NewReader(os.Stdin)
+	matches := names
+	for {
+		for i, name := range matches {
+			if i == pickerHeight {
+				fmt.Fprintf(os.Stderr, "    ... %d more\n", len(matches)-i)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "[%d] %s\n", i+1, name)
+		}
+		fmt.Fprint(os.Stderr, "Profile: ")
+
+		text, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		text = strings.TrimSpace(text)
+
+		if i, err := strconv.Atoi(text); err == nil && i >= 1 && i <= len(matches) && i <= pickerHeight {
+			return matches[i-1], nil
+		}
+		if text == "" {
+			return "", errNoProfileChosen
+		}
+
+		matches = filterProfiles(names, text)
+		switch len(matches) {
+		case 0:
+			fmt.Fprintf(os.Stderr, "No profiles match %q\n", text)
+			matches = names
+		case 1:
+			return matches[0], nil
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// policyArnRe matches the ARN of an AWS or customer managed policy.
+var policyArnRe = regexp.MustCompile(`^arn:aws[a-z-]*:iam::(aws|[0-9]{12}):policy/.+$`)
+
+const (
+	// maxSessionPolicy is the longest inline session policy STS accepts.
+	maxSessionPolicy = 2048
+
+	// maxPolicyARNs is how many managed session policies STS accepts.
+	maxPolicyARNs = 10
+
+	// packedPolicyWarning is the percentage of the packed size limit above
+	// which a warning is printed.
+	packedPolicyWarning = 90
+)
+
+// sessionPolicy scopes down the permissions of a role session: they are the
+// intersection of the role's own policies and these.
+type sessionPolicy struct {
+	// Document is an inline policy, as compact JSON.
+	Document string
+
+	// ARNs are managed policies.
+	ARNs []string
+}
+
+// IsZero reports whether the policy leaves the role's permissions as they are.
+func (p sessionPolicy) IsZero() bool {
+	return p.Document == "" && len(p.ARNs) == 0
+}
+
+// CacheKey returns key, made unique to the policy, as credentials scoped down
+// differently must be cached separately.
+func (p sessionPolicy) CacheKey(key string) string {
+	if p.IsZero() {
+		return key
+	}
+	arns := append([]string(nil), p.ARNs...)
+	sort.Strings(arns)
+	return cacheKey(key, p.Document, strings.Join(arns, ","))
+}
+
+// Merge returns the policy with the inline policy of other, if it has one,
+// and the managed policies of both.
+func (p sessionPolicy) Merge(other sessionPolicy) sessionPolicy {
+	if other.Document != "" {
+		p.Document = other.Document
+	}
+	p.ARNs = append(append([]string(nil), p.ARNs...), other.ARNs...)
+	return p
+}
+
+// Validate checks the policy against the limits of STS.
+func (p sessionPolicy) Validate() error {
+	if len(p.ARNs) > maxPolicyARNs {
+		return fmt.Errorf("%d session policy ARNs given, STS accepts at most %d", len(p.ARNs), maxPolicyARNs)
+	}
+	for _, arn := range p.ARNs {
+		if !policyArnRe.MatchString(arn) {
+			return fmt.Errorf("%q is not a managed policy ARN like arn:aws:iam::aws:policy/ReadOnlyAccess", arn)
+		}
+	}
+	if n := len(p.Document); n > maxSessionPolicy {
+		return fmt.Errorf("session policy is %d characters, STS accepts at most %d", n, maxSessionPolicy)
+	}
+	return nil
+}
+
+// warnSize warns when the inline policy is close to the length STS accepts,
+// as it is then likely to exceed the limit on its packed size as well.
+func (p sessionPolicy) warnSize() {
+	if n := len(p.Document); n*100 >= maxSessionPolicy*packedPolicyWarning {
+		fmt.Fprintf(os.Stderr, "WARNING: session policy is %d of the %d characters STS accepts, its packed size may be too large\n", n, maxSessionPolicy)
+	}
+}
+
+// policyARNs returns the managed policies as STS expects them.
+func (p sessionPolicy) policyARNs() []*sts.PolicyDescriptorType {
+	var arns []*sts.PolicyDescriptorType
+	for _, arn := range p.ARNs {
+		arns = append(arns, &sts.PolicyDescriptorType{Arn: aws.String(arn)})
+	}
+	return arns
+}
+
+// warnPackedPolicySize warns when STS reports that the session policies are
+// close to the limit of their packed size, which is a percentage.
+func warnPackedPolicySize(size *int64) {
+	if size != nil && *size >= packedPolicyWarning {
+		fmt.Fprintf(os.Stderr, "WARNING: session policies use %d%% of the packed size STS allows\n", *size)
+	}
+}
+
+// parseSessionPolicy returns a session policy with the inline policy value,
+// which is either a JSON document or the name of a file holding one, and the
+// managed policies arns.
+func parseSessionPolicy(value string, arns []string) (sessionPolicy, error) {
+	p := sessionPolicy{ARNs: arns}
+	if value == "" {
+		return p, p.Validate()
+	}
+
+	raw := []byte(value)
+	if trimmed := strings.TrimSpace(value); !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		var err error
+		if raw, err = ioutil.ReadFile(expandHome(value)); err != nil {
+			return p, fmt.Errorf("session policy: %v", err)
+		}
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return p, fmt.Errorf("session policy is not a JSON object: %v", err)
+	}
+	if _, ok := doc["Statement"]; !ok {
+		return p, fmt.Errorf("session policy has no Statement")
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return p, fmt.Errorf("session policy is not a JSON object: %v", err)
+	}
+	p.Document = buf.String()
+	return p, p.Validate()
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// expandHome expands a leading ~/ in path to the home directory.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return homeDir() + path[1:]
+	}
+	return path
+}
+
+// stringsFlag is a flag that may be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// scopeSettings is a named session policy in the settings file, which is
+// chosen by appending its name to a role, as in prod:readonly.
+type scopeSettings struct {
+	// Policy is a JSON policy document or the name of a file holding one.
+	Policy string `yaml:"policy"`
+
+	// PolicyARNs are managed policies.
+	PolicyARNs []string `yaml:"policy_arns"`
+}
+
+// scope splits the scope off role, if it names one, and returns the role and
+// the options to assume it with, which include the scope's session policy.
+func (o *options) scope(role string) (string, *options, error) {
+	i := strings.LastIndex(role, ":")
+	if i < 0 {
+		return role, o, nil
+	}
+	s, ok := o.Scopes[role[i+1:]]
+	if !ok {
+		return role, o, nil
+	}
+
+	policy, err := parseSessionPolicy(s.Policy, s.PolicyARNs)
+	if err != nil {
+		return "", nil, fmt.Errorf("scope %s: %v", role[i+1:], err)
+	}
+
+	// The flags refine the scope.
+	scoped := *o
+	scoped.Policy = policy.Merge(o.Policy)
+	if err := scoped.Policy.Validate(); err != nil {
+		return "", nil, fmt.Errorf("scope %s: %v", role[i+1:], err)
+	}
+	return role[:i], &scoped, nil
+}
+
+// policy returns the session policy to assume the role being asked for with,
+// which is configured with configured: the flags and scope refine it, as they
+// do each other.
+func (o *options) policy(configured sessionPolicy) (sessionPolicy, error) {
+	policy := configured.Merge(o.Policy)
+	return policy, policy.Validate()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// runProcess runs a shell command from the named setting and returns what it
+// prints to stdout, trimmed of whitespace. The command is killed if it takes
+// longer than timeout.
+func runProcess(setting, command string, timeout time.Duration) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%s %q: %v", setting, command, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", fmt.Errorf("%s %q failed: %v", setting, command, err)
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return "", fmt.Errorf("%s %q timed out after %s", setting, command, timeout)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
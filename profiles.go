@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// homeDir returns the current user's home directory, even when HOME is unset,
+// or an empty string if it can't be determined.
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	if runtime.GOOS == "windows" {
+		if home := os.Getenv("USERPROFILE"); home != "" {
+			return home
+		}
+	}
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir
+	}
+	return ""
+}
+
+// rolesFilename returns the location of the deprecated roles file.
+func rolesFilename() string {
+	if name := os.Getenv("ASSUME_ROLE_ROLES_FILE"); name != "" {
+		return name
+	}
+	return filepath.Join(homeDir(), ".aws", "roles")
+}
+
+// sharedConfigFilename returns the location of the AWS CLI config file, using
+// the same rules as the SDK.
+func sharedConfigFilename() string {
+	if name := os.Getenv("AWS_CONFIG_FILE"); name != "" {
+		return name
+	}
+	return filepath.Join(homeDir(), ".aws", "config")
+}
+
+// sharedCredentialsFilename returns the location of the AWS CLI credentials
+// file, using the same rules as the SDK.
+func sharedCredentialsFilename() string {
+	if name := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); name != "" {
+		return name
+	}
+	return filepath.Join(homeDir(), ".aws", "credentials")
+}
+
+// profile is a named profile from the AWS CLI config and credentials files
+// (https://docs.aws.amazon.com/cli/latest/userguide/cli-roles.html).
+type profile struct {
+	Name string
+
+	// Role settings.
+	RoleARN          string
+	SourceProfile    string
+	CredentialSource string
+	MFASerial        string
+	MFAProcess       string
+	ExternalID       string
+
+	// Web identity settings, which assume the role with an OIDC token
+	// instead of credentials.
+	WebIdentityTokenFile    string
+	WebIdentityTokenProcess string
+
+	// DurationSeconds is how long the role's credentials are valid for.
+	DurationSeconds string
+
+	// RoleSessionName is a template for the role's session name.
+	RoleSessionName string
+
+	// SessionPolicy is an inline session policy, or the name of a file
+	// holding one, and SessionPolicyARNs a comma separated list of managed
+	// session policies, which scope down the role.
+	SessionPolicy     string
+	SessionPolicyARNs string
+
+	// Tags is a comma separated list of key=value session tags, whose
+	// values are templates, and TransitiveTags a comma separated list of
+	// the keys of those that carry over to roles assumed with the role.
+	Tags           string
+	TransitiveTags string
+
+	Region string
+
+	// Long lived credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// HasKeys reports whether the profile holds its own credentials.
+func (p *profile) HasKeys() bool {
+	return p.AccessKeyID != "" && p.SecretAccessKey != ""
+}
+
+// Duration returns the profile's duration_seconds, or zero if it has none.
+func (p *profile) Duration() (time.Duration, error) {
+	if p.DurationSeconds == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(p.DurationSeconds)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("profile %s has an invalid duration_seconds %q", p.Name, p.DurationSeconds)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// Policy returns the profile's session policy.
+func (p *profile) Policy() (sessionPolicy, error) {
+	policy, err := parseSessionPolicy(p.SessionPolicy, splitList(p.SessionPolicyARNs))
+	if err != nil {
+		return policy, fmt.Errorf("profile %s: %v", p.Name, err)
+	}
+	return policy, nil
+}
+
+// SessionTags returns the profile's session tags.
+func (p *profile) SessionTags() (sessionTags, error) {
+	tags, err := parseTags(splitList(p.Tags), splitList(p.TransitiveTags))
+	if err != nil {
+		return tags, fmt.Errorf("profile %s: %v", p.Name, err)
+	}
+	return tags, nil
+}
+
+// HasWebIdentity reports whether the profile's role is assumed with a web
+// identity token.
+func (p *profile) HasWebIdentity() bool {
+	return p.RoleARN != "" && (p.WebIdentityTokenFile != "" || p.WebIdentityTokenProcess != "")
+}
+
+// profiles are all known profiles by name.
+type profiles map[string]*profile
+
+// loadProfiles loads the profiles in the AWS CLI config and credentials files.
+// Like the SDK, values in the credentials file take precedence.
+func loadProfiles() (profiles, error) {
+	p := make(profiles)
+
+	config, err := ini.LooseLoad(sharedConfigFilename())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", sharedConfigFilename(), err)
+	}
+	for _, section := range config.Sections() {
+		name := section.Name()
+		if name != "default" {
+			if !strings.HasPrefix(name, "profile ") {
+				continue
+			}
+			name = strings.TrimSpace(strings.TrimPrefix(name, "profile "))
+		}
+		p.set(name, section)
+	}
+
+	creds, err := ini.LooseLoad(sharedCredentialsFilename())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", sharedCredentialsFilename(), err)
+	}
+	for _, section := range creds.Sections() {
+		if section.Name() == ini.DEFAULT_SECTION && len(section.Keys()) == 0 {
+			continue
+		}
+		p.set(section.Name(), section)
+	}
+
+	return p, nil
+}
+
+// set merges the keys in section into the named profile.
+func (p profiles) set(name string, section *ini.Section) {
+	prof, ok := p[name]
+	if !ok {
+		prof = &profile{Name: name}
+		p[name] = prof
+	}
+
+	for key, dst := range map[string]*string{
+		"role_arn":                   &prof.RoleARN,
+		"source_profile":             &prof.SourceProfile,
+		"credential_source":          &prof.CredentialSource,
+		"mfa_serial":                 &prof.MFASerial,
+		"mfa_process":                &prof.MFAProcess,
+		"external_id":                &prof.ExternalID,
+		"web_identity_token_file":    &prof.WebIdentityTokenFile,
+		"web_identity_token_process": &prof.WebIdentityTokenProcess,
+		"duration_seconds":           &prof.DurationSeconds,
+		"role_session_name":          &prof.RoleSessionName,
+		"session_policy":             &prof.SessionPolicy,
+		"session_policy_arns":        &prof.SessionPolicyARNs,
+		"tags":                       &prof.Tags,
+		"transitive_tags":            &prof.TransitiveTags,
+		"region":                     &prof.Region,
+		"aws_access_key_id":          &prof.AccessKeyID,
+		"aws_secret_access_key":      &prof.SecretAccessKey,
+		"aws_session_token":          &prof.SessionToken,
+	} {
+		if section.HasKey(key) {
+			*dst = section.Key(key).String()
+		}
+	}
+}
+
+// Chain returns the profiles that must be assumed in turn to get credentials
+// for the named profile, following source_profile to any depth. The first
+// profile provides the initial credentials, either its own keys, its
+// credential_source or its web identity token, and every other profile is a
+// role to assume with the credentials of the one before it.
+func (p profiles) Chain(name string) ([]*profile, error) {
+	var chain []*profile
+	var visited []string
+
+	for {
+		prof, ok := p[name]
+		if !ok {
+			if len(chain) == 0 {
+				return nil, fmt.Errorf("profile %s not found in %s", name, sharedConfigFilename())
+			}
+			return nil, fmt.Errorf("source_profile %s of profile %s not found", name, chain[0].Name)
+		}
+
+		for i, v := range visited {
+			if v == name {
+				loop := append(visited[i:], name)
+				return nil, fmt.Errorf("source_profile loop: %s", strings.Join(loop, " -> "))
+			}
+		}
+		visited = append(visited, name)
+		chain = append([]*profile{prof}, chain...)
+
+		switch {
+		case prof.RoleARN == "":
+			// A profile without a role can only provide credentials.
+			if !prof.HasKeys() {
+				return nil, fmt.Errorf("profile %s has neither credentials nor a role_arn", prof.Name)
+			}
+			return chain, nil
+		case prof.HasWebIdentity():
+			// The role is assumed with a web identity token, so it
+			// needs no other credentials.
+			return chain, nil
+		case prof.CredentialSource != "":
+			// The role is assumed with credentials from the
+			// environment, so the chain is prefixed with an anonymous
+			// profile that stands for them.
+			return append([]*profile{{Name: prof.CredentialSource}}, chain...), nil
+		case prof.SourceProfile == prof.Name && prof.HasKeys():
+			// The role is assumed with the profile's own keys.
+			return append([]*profile{{
+				Name:            prof.Name,
+				AccessKeyID:     prof.AccessKeyID,
+				SecretAccessKey: prof.SecretAccessKey,
+				SessionToken:    prof.SessionToken,
+			}}, chain...), nil
+		case prof.SourceProfile == "":
+			return nil, fmt.Errorf("profile %s has a role_arn but no source_profile or credential_source", prof.Name)
+		}
+
+		name = prof.SourceProfile
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// refreshingCredentials holds temporary credentials in memory for long running
+// modes, retrieving new ones whenever they are about to expire.
+type refreshingCredentials struct {
+	// Retrieve returns new credentials.
+	Retrieve func() (*tempCredentials, error)
+
+	// Window is how long before expiration credentials are refreshed.
+	Window time.Duration
+
+	mu    sync.Mutex
+	creds *tempCredentials
+}
+
+// Get returns the current credentials, refreshing them first if needed. It is
+// safe to call from multiple goroutines.
+func (r *refreshingCredentials) Get() (*tempCredentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.creds != nil && !r.creds.expired(r.Window) {
+		return r.creds, nil
+	}
+
+	creds, err := r.Retrieve()
+	if err != nil {
+		return nil, err
+	}
+	r.creds = creds
+	return creds, nil
+}
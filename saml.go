@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Attributes of a SAML assertion that AWS uses
+// (https://docs.aws.amazon.com/IAM/latest/UserGuide/id_roles_providers_create_saml_assertions.html).
+const (
+	samlRoleAttribute            = "https://aws.amazon.com/SAML/Attributes/Role"
+	samlSessionDurationAttribute = "https://aws.amazon.com/SAML/Attributes/SessionDuration"
+)
+
+// samlRole is a role that a SAML assertion allows assuming.
+type samlRole struct {
+	RoleARN      string
+	PrincipalARN string
+}
+
+// samlAssertion is a base64 encoded SAML response from an IdP.
+type samlAssertion string
+
+// Roles returns the roles listed in the assertion's Role attribute, along with
+// the maximum session duration the IdP allows, if any.
+func (a samlAssertion) Roles() ([]samlRole, time.Duration, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(a)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("SAML response is not valid base64: %v", err)
+	}
+
+	var (
+		roles    []samlRole
+		duration time.Duration
+	)
+
+	d := xml.NewDecoder(bytes.NewReader(raw))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("SAML response is not valid XML: %v", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "Attribute" {
+			continue
+		}
+
+		var attr struct {
+			Name   string   `xml:"Name,attr"`
+			Values []string `xml:"AttributeValue"`
+		}
+		if err := d.DecodeElement(&attr, &start); err != nil {
+			return nil, 0, err
+		}
+
+		switch attr.Name {
+		case samlRoleAttribute:
+			for _, v := range attr.Values {
+				role, err := parseSAMLRole(v)
+				if err != nil {
+					return nil, 0, err
+				}
+				roles = append(roles, role)
+			}
+		case samlSessionDurationAttribute:
+			if len(attr.Values) > 0 {
+				seconds, err := strconv.Atoi(strings.TrimSpace(attr.Values[0]))
+				if err == nil {
+					duration = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+
+	if len(roles) == 0 {
+		return nil, 0, errors.New("SAML response does not allow assuming any roles")
+	}
+	return roles, duration, nil
+}
+
+// parseSAMLRole parses a value of the Role attribute, which is a role ARN and
+// a SAML provider ARN separated by a comma, in either order.
+func parseSAMLRole(v string) (samlRole, error) {
+	var role samlRole
+	for _, arn := range strings.Split(v, ",") {
+		arn = strings.TrimSpace(arn)
+		switch {
+		case strings.Contains(arn, ":role/"):
+			role.RoleARN = arn
+		case strings.Contains(arn, ":saml-provider/"):
+			role.PrincipalARN = arn
+		}
+	}
+	if role.RoleARN == "" || role.PrincipalARN == "" {
+		return role, fmt.Errorf("invalid SAML role %q", v)
+	}
+	return role, nil
+}
+
+// assumeRoleWithSAML exchanges the assertion for temporary credentials for
+// role.
+func assumeRoleWithSAML(assertion samlAssertion, role samlRole, duration time.Duration) (*tempCredentials, error) {
+	sess := newSession(nil, roleRegion(role.RoleARN, ""))
+
+	resp, err := sts.New(sess).AssumeRoleWithSAML(&sts.AssumeRoleWithSAMLInput{
+		RoleArn:         aws.String(role.RoleARN),
+		PrincipalArn:    aws.String(role.PrincipalARN),
+		SAMLAssertion:   aws.String(strings.TrimSpace(string(assertion))),
+		DurationSeconds: aws.Int64(int64(duration / time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var creds tempCredentials
+	creds.AccessKeyID = *resp.Credentials.AccessKeyId
+	creds.SecretAccessKey = *resp.Credentials.SecretAccessKey
+	creds.SessionToken = *resp.Credentials.SessionToken
+	creds.Expiration = *resp.Credentials.Expiration
+	creds.AssumedRoleARN = *resp.AssumedRoleUser.Arn
+	creds.RoleSessionName = creds.AssumedRoleARN[strings.LastIndex(creds.AssumedRoleARN, "/")+1:]
+	creds.Region = aws.StringValue(sess.Config.Region)
+	return &creds, nil
+}
+
+// chooseSAMLRole returns the role matching roleARN, the only role, or asks
+// which role to use on the terminal.
+func chooseSAMLRole(roles []samlRole, roleARN string) (samlRole, error) {
+	if roleARN != "" {
+		for _, role := range roles {
+			if role.RoleARN == roleARN {
+				return role, nil
+			}
+		}
+		return samlRole{}, fmt.Errorf("SAML response does not allow assuming %s", roleARN)
+	}
+
+	if len(roles) == 1 {
+		return roles[0], nil
+	}
+
+	t, err := openTTY()
+	if err != nil {
+		return samlRole{}, errors.New("SAML response allows assuming several roles, choose one with -role")
+	}
+	defer t.Close()
+
+	for i, role := range roles {
+		fmt.Fprintf(t.Out, "[%d] %s\n", i+1, role.RoleARN)
+	}
+	fmt.Fprintf(t.Out, "Role: ")
+	text, err := bufio.NewReader(t.In).ReadString('\n')
+	if err != nil {
+		return samlRole{}, err
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || i < 1 || i > len(roles) {
+		return samlRole{}, fmt.Errorf("invalid choice %q", strings.TrimSpace(text))
+	}
+	return roles[i-1], nil
+}
+
+// samlSettings configure signing in to a SAML IdP with an HTML login form.
+type samlSettings struct {
+	// IdPURL is the page with the login form, which posts the SAML
+	// response to AWS after signing in.
+	IdPURL string `yaml:"idp_url"`
+
+	Username string `yaml:"username"`
+
+	// UsernameField and PasswordField name the form inputs to fill in. By
+	// default the first text or email input and the first password input
+	// are used.
+	UsernameField string `yaml:"username_field"`
+	PasswordField string `yaml:"password_field"`
+}
+
+var (
+	htmlFormRe  = regexp.MustCompile(`(?is)<form\b([^>]*)>(.*?)</form>`)
+	htmlInputRe = regexp.MustCompile(`(?is)<input\b([^>]*)>`)
+	htmlAttrRe  = regexp.MustCompile(`(?s)([a-zA-Z_:][-a-zA-Z0-9_:.]*)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// htmlAttrs parses the attributes of an HTML tag.
+func htmlAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range htmlAttrRe.FindAllStringSubmatch(s, -1) {
+		v := m[2]
+		if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, `'`) {
+			v = v[1 : len(v)-1]
+		}
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(v)
+	}
+	return attrs
+}
+
+// samlLogin signs in to the IdP by submitting its login form and returns the
+// SAML response from the page it responds with.
+func samlLogin(s *samlSettings, password string) (samlAssertion, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.Get(s.IdPURL)
+	if err != nil {
+		return "", err
+	}
+	page, err := readHTML(resp)
+	if err != nil {
+		return "", err
+	}
+
+	m := findLoginForm(page, s)
+	if m == nil {
+		return "", fmt.Errorf("no login form found at %s", s.IdPURL)
+	}
+	action, err := resp.Request.URL.Parse(htmlAttrs(m[1])["action"])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	var haveUsername, havePassword bool
+	for _, input := range htmlInputRe.FindAllStringSubmatch(m[2], -1) {
+		attrs := htmlAttrs(input[1])
+		name, typ := attrs["name"], strings.ToLower(attrs["type"])
+		if name == "" {
+			continue
+		}
+
+		switch {
+		case !haveUsername && (name == s.UsernameField || s.UsernameField == "" && (typ == "" || typ == "text" || typ == "email")):
+			form.Set(name, s.Username)
+			haveUsername = true
+		case !havePassword && (name == s.PasswordField || s.PasswordField == "" && typ == "password"):
+			form.Set(name, password)
+			havePassword = true
+		case typ == "submit" || typ == "button":
+		default:
+			form.Set(name, attrs["value"])
+		}
+	}
+	if !haveUsername || !havePassword {
+		return "", fmt.Errorf("login form at %s has no username or password field", s.IdPURL)
+	}
+
+	resp, err = client.PostForm(action.String(), form)
+	if err != nil {
+		return "", err
+	}
+	page, err = readHTML(resp)
+	if err != nil {
+		return "", err
+	}
+
+	for _, input := range htmlInputRe.FindAllStringSubmatch(page, -1) {
+		attrs := htmlAttrs(input[1])
+		if attrs["name"] == "SAMLResponse" {
+			return samlAssertion(attrs["value"]), nil
+		}
+	}
+	return "", errors.New("login failed, the IdP did not respond with a SAML response")
+}
+
+// findLoginForm returns the submatches of htmlFormRe for the first form on
+// page with a password input, as login pages often have other forms too.
+func findLoginForm(page string, s *samlSettings) []string {
+	for _, m := range htmlFormRe.FindAllStringSubmatch(page, -1) {
+		for _, input := range htmlInputRe.FindAllStringSubmatch(m[2], -1) {
+			attrs := htmlAttrs(input[1])
+			if attrs["name"] != "" && (attrs["name"] == s.PasswordField || s.PasswordField == "" && strings.ToLower(attrs["type"]) == "password") {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func readHTML(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s responded with %s", resp.Request.URL, resp.Status)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	return string(raw), err
+}
+
+// saml implements `assume-role saml`, which assumes a role with a SAML
+// response from an IdP, read from a file or stdin or by signing in to the IdP.
+func saml(args []string, s *settings, opts *options) error {
+	fs := flag.NewFlagSet("saml", flag.ExitOnError)
+	var (
+		assertionFile = fs.String("assertion", "", "A file containing the base64 encoded SAML response, or - for stdin.")
+		idpURL        = fs.String("idp-url", s.SAML.IdPURL, "The IdP login page to sign in to for a SAML response.")
+		username      = fs.String("username", s.SAML.Username, "The username to sign in to the IdP with.")
+		roleARN       = fs.String("role", "", "The role to assume, when the SAML response allows several.")
+	)
+	fs.Usage = usage
+	fs.Parse(args)
+
+	idp := s.SAML
+	idp.IdPURL, idp.Username = *idpURL, *username
+
+	getAssertion := func() (samlAssertion, error) {
+		switch {
+		case *assertionFile == "-":
+			raw, err := ioutil.ReadAll(os.Stdin)
+			return samlAssertion(raw), err
+		case *assertionFile != "":
+			raw, err := ioutil.ReadFile(*assertionFile)
+			return samlAssertion(raw), err
+		case idp.IdPURL != "":
+			if idp.Username == "" {
+				return "", errors.New("a username is required to sign in to the IdP")
+			}
+			password, err := readPassphrase(fmt.Sprintf("Password for %s: ", idp.Username))
+			if err != nil {
+				return "", err
+			}
+			return samlLogin(&idp, password)
+		default:
+			return "", errors.New("either -assertion or -idp-url is required")
+		}
+	}
+
+	role := *roleARN
+	retrieve := func(assertion samlAssertion) (*tempCredentials, error) {
+		roles, maxDuration, err := assertion.Roles()
+		if err != nil {
+			return nil, err
+		}
+		chosen, err := chooseSAMLRole(roles, *roleARN)
+		if err != nil {
+			return nil, err
+		}
+		role = chosen.RoleARN
+
+		duration := opts.duration(0)
+		if maxDuration > 0 && duration > maxDuration {
+			duration = maxDuration
+		}
+		return assumeRoleWithSAML(assertion, chosen, duration)
+	}
+
+	var (
+		creds *tempCredentials
+		err   error
+	)
+	if *roleARN != "" {
+		// The role is known up front, so cached credentials can be used
+		// without signing in to the IdP again.
+		creds, err = opts.Cache.Fetch(cacheKey("saml", *roleARN, opts.duration(0).String()), func() (*tempCredentials, error) {
+			assertion, err := getAssertion()
+			if err != nil {
+				return nil, err
+			}
+			return retrieve(assertion)
+		})
+	} else {
+		var assertion samlAssertion
+		assertion, err = getAssertion()
+		if err == nil {
+			creds, err = retrieve(assertion)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return useCredentials(role, fs.Args(), creds, opts)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testRoleARN     = "arn:aws:iam::123456789012:role/admin"
+	testProviderARN = "arn:aws:iam::123456789012:saml-provider/idp"
+	testOtherRole   = "arn:aws:iam::123456789012:role/readonly"
+)
+
+// testSAMLResponse returns a base64 encoded SAML response with the Role
+// attribute values roles and a SessionDuration of seconds.
+func testSAMLResponse(seconds int, roles ...string) string {
+	var values string
+	for _, role := range roles {
+		values += "<saml:AttributeValue>" + role + "</saml:AttributeValue>"
+	}
+	xml := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">
+<saml:Assertion><saml:AttributeStatement>
+<saml:Attribute Name="https://aws.amazon.com/SAML/Attributes/RoleSessionName"><saml:AttributeValue>jane</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="` + samlRoleAttribute + `">` + values + `</saml:Attribute>
+<saml:Attribute Name="` + samlSessionDurationAttribute + `"><saml:AttributeValue>` + fmt.Sprint(seconds) + `</saml:AttributeValue></saml:Attribute>
+</saml:AttributeStatement></saml:Assertion>
+</samlp:Response>`
+	return base64.StdEncoding.EncodeToString([]byte(xml))
+}
+
+func TestSAMLAssertionRoles(t *testing.T) {
+	assertion := samlAssertion(testSAMLResponse(7200,
+		testRoleARN+","+testProviderARN,
+		testProviderARN+", "+testOtherRole,
+	))
+
+	roles, duration, err := assertion.Roles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []samlRole{
+		{RoleARN: testRoleARN, PrincipalARN: testProviderARN},
+		{RoleARN: testOtherRole, PrincipalARN: testProviderARN},
+	}
+	if len(roles) != len(want) {
+		t.Fatalf("roles = %v, want %v", roles, want)
+	}
+	for i := range want {
+		if roles[i] != want[i] {
+			t.Errorf("roles[%d] = %v, want %v", i, roles[i], want[i])
+		}
+	}
+	if duration != 2*time.Hour {
+		t.Errorf("duration = %v, want 2h", duration)
+	}
+}
+
+func TestSAMLAssertionRolesInvalid(t *testing.T) {
+	tests := []samlAssertion{
+		"not base64!",
+		samlAssertion(testSAMLResponse(3600)),
+		samlAssertion(testSAMLResponse(3600, testRoleARN)),
+	}
+	for _, assertion := range tests {
+		if _, _, err := assertion.Roles(); err == nil {
+			t.Errorf("%q: expected an error", assertion)
+		}
+	}
+}
+
+// newTestIdP returns an IdP with a login form at / that responds with
+// response to jane signing in with the password hunter2.
+func newTestIdP(t *testing.T, response string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cr3t"})
+		fmt.Fprint(w, `<html><body>
+<form id="search" action="/search"></form>
+<form method="post" action='/login?flow=1'>
+  <input type="hidden" name="csrf" value="t&amp;ok">
+  <input name="user" type="email">
+  <input type="password" name="pass">
+  <input type="checkbox" name="remember" value="yes">
+  <input type="submit" name="go" value="Sign in">
+</form>
+</body></html>`)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s3cr3t" {
+			t.Errorf("login: session cookie was not sent back")
+		}
+		for field, want := range map[string]string{
+			"flow":     "1",
+			"csrf":     "t&ok",
+			"user":     "jane",
+			"remember": "yes",
+			"go":       "",
+		} {
+			if got := r.Form.Get(field); got != want {
+				t.Errorf("login: %s = %q, want %q", field, got, want)
+			}
+		}
+		if r.Form.Get("pass") != "hunter2" {
+			fmt.Fprint(w, `<p>Wrong password</p>`)
+			return
+		}
+		fmt.Fprintf(w, `<form action="https://signin.aws.amazon.com/saml" method="post">
+<input type="hidden" name="RelayState" value="">
+<input type="hidden" name="SAMLResponse" value="%s">
+</form>`, html.EscapeString(response))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestSAMLLogin(t *testing.T) {
+	response := testSAMLResponse(3600, testProviderARN+","+testRoleARN)
+	idp := newTestIdP(t, response)
+	defer idp.Close()
+
+	assertion, err := samlLogin(&samlSettings{IdPURL: idp.URL, Username: "jane"}, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(assertion) != response {
+		t.Errorf("assertion = %q, want %q", assertion, response)
+	}
+}
+
+func TestSAMLLoginNamedFields(t *testing.T) {
+	var form map[string][]string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fmt.Fprint(w, `<form method="post">
+<input type="text" name="search">
+<input type="text" name="login">
+<input type="password" name="otp">
+<input type="password" name="secret">
+</form>`)
+			return
+		}
+		r.ParseForm()
+		form = r.Form
+		fmt.Fprint(w, `<input name="SAMLResponse" value="abc">`)
+	}))
+	defer idp.Close()
+
+	s := &samlSettings{IdPURL: idp.URL, Username: "jane", UsernameField: "login", PasswordField: "secret"}
+	assertion, err := samlLogin(s, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertion != "abc" {
+		t.Errorf("assertion = %q, want abc", assertion)
+	}
+	if got := fmt.Sprint(form); got != "map[login:[jane] otp:[] search:[] secret:[hunter2]]" {
+		t.Errorf("form = %s, want login=jane and secret=hunter2", got)
+	}
+}
+
+func TestSAMLLoginFailed(t *testing.T) {
+	idp := newTestIdP(t, "")
+	defer idp.Close()
+
+	_, err := samlLogin(&samlSettings{IdPURL: idp.URL, Username: "jane"}, "wrong")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestAssumeRoleWithSAML(t *testing.T) {
+	response := testSAMLResponse(3600, testRoleARN+","+testProviderARN)
+	idp := newTestIdP(t, response)
+	defer idp.Close()
+
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		for field, want := range map[string]string{
+			"Action":          "AssumeRoleWithSAML",
+			"RoleArn":         testRoleARN,
+			"PrincipalArn":    testProviderARN,
+			"SAMLAssertion":   response,
+			"DurationSeconds": "3600",
+		} {
+			if got := r.Form.Get(field); got != want {
+				t.Errorf("sts: %s = %q, want %q", field, got, want)
+			}
+		}
+		fmt.Fprint(w, `<AssumeRoleWithSAMLResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleWithSAMLResult>
+<Credentials>
+<AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+<SecretAccessKey>secret</SecretAccessKey>
+<SessionToken>token</SessionToken>
+<Expiration>2030-01-01T00:00:00Z</Expiration>
+</Credentials>
+<AssumedRoleUser>
+<Arn>arn:aws:sts::123456789012:assumed-role/admin/jane</Arn>
+<AssumedRoleId>AROAEXAMPLE:jane</AssumedRoleId>
+</AssumedRoleUser>
+</AssumeRoleWithSAMLResult>
+</AssumeRoleWithSAMLResponse>`)
+	}))
+	defer sts.Close()
+
+	defer func(endpoint string) { stsEndpoint = endpoint }(stsEndpoint)
+	stsEndpoint = sts.URL
+
+	assertion, err := samlLogin(&samlSettings{IdPURL: idp.URL, Username: "jane"}, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, duration, err := assertion.Roles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, err := chooseSAMLRole(roles, testRoleARN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := assumeRoleWithSAML(assertion, role, duration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ASIAEXAMPLE" || creds.SessionToken != "token" {
+		t.Errorf("creds = %+v, want the ones STS returned", creds)
+	}
+	if creds.RoleSessionName != "jane" {
+		t.Errorf("RoleSessionName = %q, want jane", creds.RoleSessionName)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables that point the AWS SDKs at a credential server.
+const (
+	containerCredentialsURIEnv = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	containerAuthorizationEnv  = "AWS_CONTAINER_AUTHORIZATION_TOKEN"
+	containerCredentialsRelEnv = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+)
+
+// overridingCredentialsEnv are the environment variables that take precedence
+// over a credential server in the AWS SDKs, either directly or by selecting a
+// profile from the shared config and credentials files.
+var overridingCredentialsEnv = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_SECURITY_TOKEN",
+	"AWS_PROFILE",
+	"AWS_DEFAULT_PROFILE",
+	containerCredentialsRelEnv,
+}
+
+// credentialServer serves credentials over HTTP using the same JSON contract
+// as the ECS container credentials endpoint, which is what the endpointcreds
+// provider in the AWS SDKs consumes.
+type credentialServer struct {
+	Credentials *refreshingCredentials
+
+	// Token must be sent in the Authorization header of every request.
+	Token string
+}
+
+// newCredentialServer returns a credentialServer with a random authorization
+// token.
+func newCredentialServer(creds *refreshingCredentials) (*credentialServer, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return &credentialServer{
+		Credentials: creds,
+		Token:       hex.EncodeToString(token),
+	}, nil
+}
+
+// containerCredentials is the response body of a credential server.
+type containerCredentials struct {
+	AccessKeyID     string     `json:"AccessKeyId"`
+	SecretAccessKey string     `json:"SecretAccessKey"`
+	Token           string     `json:"Token"`
+	Expiration      *time.Time `json:"Expiration,omitempty"`
+}
+
+// containerError is the response body of a credential server when credentials
+// can't be provided.
+type containerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s *credentialServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusMethodNotAllowed, &containerError{"MethodNotAllowed", "only GET is supported"})
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.Token)) != 1 {
+		writeJSON(w, http.StatusForbidden, &containerError{"AccessDenied", "invalid authorization token"})
+		return
+	}
+
+	creds, err := s.Credentials.Get()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		writeJSON(w, http.StatusInternalServerError, &containerError{"CredentialsError", err.Error()})
+		return
+	}
+
+	resp := &containerCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		Token:           creds.SessionToken,
+	}
+	if !creds.Expiration.IsZero() {
+		expiration := creds.Expiration.UTC()
+		resp.Expiration = &expiration
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Env returns the environment variables that direct the AWS SDKs to the
+// server listening on addr.
+func (s *credentialServer) Env(addr net.Addr) [][2]string {
+	return [][2]string{
+		{containerCredentialsURIEnv, fmt.Sprintf("http://%s/", addr)},
+		{containerAuthorizationEnv, s.Token},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serve implements `assume-role serve`, which runs a credential server for a
+// role until interrupted.
+func serve(args []string, opts *options) error {
+	role, creds, ln, err := listenForRole("serve", "127.0.0.1:0", args, opts)
+	if err != nil {
+		return err
+	}
+
+	srv, err := newCredentialServer(creds)
+	if err != nil {
+		return err
+	}
+
+	warnDefaultProfile(role)
+	printEnv(opts.Format, srv.Env(ln.Addr()))
+	fmt.Fprintf(os.Stderr, "Serving credentials for %s on %s\n", role, ln.Addr())
+	return http.Serve(ln, srv)
+}
+
+// listenForRole parses the arguments of a subcommand that serves credentials
+// for a role, listening on -addr, which defaults to addr. It returns the role,
+// its credentials and the listener.
+func listenForRole(name, addr string, args []string, opts *options) (string, *refreshingCredentials, net.Listener, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	listenAddr := fs.String("addr", addr, "The address to listen on.")
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	role := fs.Arg(0)
+
+	creds := opts.refreshing(role)
+
+	// Retrieve credentials up front so that MFA prompts and configuration
+	// errors happen before anything starts relying on the server.
+	if _, err := creds.Get(); err != nil {
+		return "", nil, nil, err
+	}
+
+	ln, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return role, creds, ln, nil
+}
+
+// execWithServer runs the command as a child process that gets its credentials
+// from a credential server on a random local port, so that they are refreshed
+// for as long as it runs.
+func execWithServer(role string, argv []string, creds *refreshingCredentials) error {
+	argv0, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+
+	if _, err := creds.Get(); err != nil {
+		return err
+	}
+
+	srv, err := newCredentialServer(creds)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	go http.Serve(ln, srv)
+
+	warnDefaultProfile(role)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !isOverridingCredentialsEnv(kv) {
+			env = append(env, kv)
+		}
+	}
+	for _, kv := range srv.Env(ln.Addr()) {
+		env = append(env, kv[0]+"="+kv[1])
+	}
+	env = append(env, "ASSUMED_ROLE="+role)
+
+	cmd := exec.Command(argv0, argv[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Forward signals to the child, which is responsible for exiting.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// Exit like the child did, as a shell would.
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+			os.Exit(status.ExitStatus())
+		}
+	}
+	return err
+}
+
+// warnDefaultProfile warns when the default profile has keys, which the AWS
+// SDKs use before a credential server, so that whatever uses the server would
+// run as the default profile's user instead of role.
+func warnDefaultProfile(role string) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return
+	}
+	if prof, ok := profiles["default"]; ok && prof.HasKeys() {
+		fmt.Fprintf(os.Stderr, "WARNING: the default profile has keys, which AWS SDKs use instead of the credentials for %s, move them to a named profile\n", role)
+	}
+}
+
+// isOverridingCredentialsEnv reports whether kv sets a variable that would take
+// precedence over a credential server.
+func isOverridingCredentialsEnv(kv string) bool {
+	for _, name := range overridingCredentialsEnv {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
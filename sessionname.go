@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultRoleSessionName is the session name roles are assumed with when no
+// role_session_name is configured.
+const defaultRoleSessionName = "cli"
+
+// maxRoleSessionName is the longest session name STS accepts.
+const maxRoleSessionName = 64
+
+// sessionNameData is what role_session_name and tag templates can refer to,
+// e.g. "{{.User}}@{{.Host}}". Methods are only called when a template uses
+// them.
+type sessionNameData struct {
+	// Profile is the profile or role being assumed.
+	Profile string
+
+	time time.Time
+}
+
+// User returns the local username, without a Windows domain.
+func (d sessionNameData) User() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	return u.Username[strings.LastIndex(u.Username, `\`)+1:]
+}
+
+// Host returns the local hostname, without its domain.
+func (d sessionNameData) Host() string {
+	host, _ := os.Hostname()
+	if i := strings.Index(host, "."); i > 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// GitEmail returns the user.email configured for git.
+func (d sessionNameData) GitEmail() string {
+	out, err := exec.Command("git", "config", "user.email").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Env returns the value of the environment variable name, e.g. for
+// "{{.Env "TEAM"}}".
+func (d sessionNameData) Env(name string) string {
+	return os.Getenv(name)
+}
+
+// Timestamp returns the time the role is assumed at, in UTC.
+func (d sessionNameData) Timestamp() string {
+	return d.time.UTC().Format("20060102T150405Z")
+}
+
+// renderSessionName renders a role_session_name template for assuming
+// profile, and makes the result a valid session name: characters STS doesn't
+// allow are replaced with dashes and it is cut to 64 characters.
+func renderSessionName(tmpl, profile string) (string, error) {
+	name, err := renderTemplate("role_session_name", tmpl, profile)
+	if err != nil {
+		return "", err
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("_+=,.@-", r):
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+	if len(name) > maxRoleSessionName {
+		name = name[:maxRoleSessionName]
+	}
+	if len(name) < 2 {
+		return "", fmt.Errorf("role_session_name %q renders to %q, which is too short", tmpl, name)
+	}
+	return name, nil
+}
+
+// renderTemplate renders the setting called name, a template, for assuming
+// profile.
+func renderTemplate(name, tmpl, profile string) (string, error) {
+	t, err := template.New(name).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, sessionNameData{Profile: profile, time: time.Now()}); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return buf.String(), nil
+}
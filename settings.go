@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+var settingsFilePath = fmt.Sprintf("%s/.aws/assume-role/config.yml", homeDir())
+
+// settings are per user preferences for assume-role itself, as opposed to
+// the roles it assumes.
+type settings struct {
+	// Keyring selects the storage backend for cached credentials. See
+	// keyringBackends for the available names.
+	Keyring string `yaml:"keyring"`
+
+	// MFASession enables assuming roles that require MFA from a cached
+	// GetSessionToken session, like the -mfa-session flag.
+	MFASession bool `yaml:"mfa_session"`
+
+	// MFAProcess is a command that prints MFA codes, used for every role
+	// that doesn't have its own mfa_process.
+	MFAProcess string `yaml:"mfa_process"`
+
+	// NegotiateDuration enables retrying with the longest duration a role
+	// allows when it doesn't allow the requested one, like the
+	// -negotiate-duration flag.
+	NegotiateDuration bool `yaml:"negotiate_duration"`
+
+	// Scopes are named session policies, chosen by appending a name to a
+	// role, as in prod:readonly.
+	Scopes map[string]scopeSettings `yaml:"scopes"`
+
+	// SAML configures signing in to a SAML IdP for `assume-role saml`.
+	SAML samlSettings `yaml:"saml"`
+
+	// TOTPKeyring selects the storage backend for enrolled TOTP secrets,
+	// which defaults to encrypted-file.
+	TOTPKeyring string `yaml:"totp_keyring"`
+}
+
+// loadSettings loads the settings file. A missing file yields the defaults.
+func loadSettings() (*settings, error) {
+	s := settings{TOTPKeyring: "encrypted-file"}
+
+	raw, err := ioutil.ReadFile(settingsFilePath)
+	if os.IsNotExist(err) {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", settingsFilePath, err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// tagRe matches the characters STS allows in tag keys and values.
+var tagRe = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+const (
+	// maxTags is how many session tags STS accepts.
+	maxTags = 50
+
+	// maxTagKey and maxTagValue are the longest tag keys and values STS
+	// accepts.
+	maxTagKey   = 128
+	maxTagValue = 256
+)
+
+// sessionTags are passed to a role session, whose policies can refer to them
+// as aws:PrincipalTag.
+type sessionTags struct {
+	// Tags are the values by key. The values are templates, like
+	// role_session_name, until they are rendered.
+	Tags map[string]string
+
+	// Transitive are the keys of the tags that carry over to roles assumed
+	// with the session.
+	Transitive []string
+}
+
+// parseTags returns session tags for a list of key=value pairs, of which the
+// keys in transitive are transitive.
+func parseTags(pairs, transitive []string) (sessionTags, error) {
+	t := sessionTags{Tags: make(map[string]string), Transitive: transitive}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return t, fmt.Errorf("tag %q is not like key=value", pair)
+		}
+		t.Tags[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return t, t.Validate()
+}
+
+// IsZero reports whether there are no tags.
+func (t sessionTags) IsZero() bool {
+	return len(t.Tags) == 0 && len(t.Transitive) == 0
+}
+
+// Keys returns the tag keys, sorted.
+func (t sessionTags) Keys() []string {
+	var keys []string
+	for key := range t.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String returns the tags as a comma separated list of key=value pairs.
+func (t sessionTags) String() string {
+	var pairs []string
+	for _, key := range t.Keys() {
+		pairs = append(pairs, key+"="+t.Tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// CacheKey returns key, made unique to the tags, as sessions with different
+// tags are allowed different things and must be cached separately.
+func (t sessionTags) CacheKey(key string) string {
+	if t.IsZero() {
+		return key
+	}
+	transitive := append([]string(nil), t.Transitive...)
+	sort.Strings(transitive)
+	return cacheKey(key, t.String(), strings.Join(transitive, ","))
+}
+
+// Merge returns the tags with those of other added, replacing any with the
+// same key.
+func (t sessionTags) Merge(other sessionTags) sessionTags {
+	merged := sessionTags{Tags: make(map[string]string)}
+	transitive := make(map[string]bool)
+	for _, tags := range []sessionTags{t, other} {
+		for key, value := range tags.Tags {
+			merged.Tags[key] = value
+		}
+		for _, key := range tags.Transitive {
+			if !transitive[key] {
+				transitive[key] = true
+				merged.Transitive = append(merged.Transitive, key)
+			}
+		}
+	}
+	return merged
+}
+
+// Validate checks the tag keys and templates. The values are only known once
+// they are rendered.
+func (t sessionTags) Validate() error {
+	if len(t.Tags) > maxTags {
+		return fmt.Errorf("%d tags given, STS accepts at most %d", len(t.Tags), maxTags)
+	}
+	for key, value := range t.Tags {
+		if key == "" || len(key) > maxTagKey || !tagRe.MatchString(key) {
+			return fmt.Errorf("tag key %q must be 1 to %d letters, digits, spaces or any of _.:/=+-@", key, maxTagKey)
+		}
+		if _, err := template.New("tags").Parse(value); err != nil {
+			return fmt.Errorf("invalid tag %s: %v", key, err)
+		}
+	}
+	for _, key := range t.Transitive {
+		if _, ok := t.Tags[key]; !ok {
+			return fmt.Errorf("transitive tag %q is not one of the tags", key)
+		}
+	}
+	return nil
+}
+
+// render returns the tags with their values rendered for assuming profile.
+func (t sessionTags) render(profile string) (sessionTags, error) {
+	if t.IsZero() {
+		return t, nil
+	}
+
+	rendered := sessionTags{Tags: make(map[string]string), Transitive: t.Transitive}
+	for key, tmpl := range t.Tags {
+		value, err := renderTemplate("tag "+key, tmpl, profile)
+		if err != nil {
+			return rendered, err
+		}
+		if len(value) > maxTagValue || !tagRe.MatchString(value) {
+			return rendered, fmt.Errorf("tag %s is %q, which isn't up to %d letters, digits, spaces or any of _.:/=+-@", key, value, maxTagValue)
+		}
+		rendered.Tags[key] = value
+	}
+	return rendered, nil
+}
+
+// stsTags returns the tags and transitive tag keys as STS expects them.
+func (t sessionTags) stsTags() ([]*sts.Tag, []*string) {
+	var (
+		tags       []*sts.Tag
+		transitive []*string
+	)
+	for _, key := range t.Keys() {
+		tags = append(tags, &sts.Tag{Key: aws.String(key), Value: aws.String(t.Tags[key])})
+	}
+	for _, key := range t.Transitive {
+		transitive = append(transitive, aws.String(key))
+	}
+	return tags, transitive
+}
+
+// inheritTags adds the transitive tags of source, which STS carries over to
+// sessions assumed with it, to the credentials' tags.
+func (c *tempCredentials) inheritTags(source *tempCredentials) {
+	if source == nil || len(source.TransitiveTagKeys) == 0 {
+		return
+	}
+	if c.Tags == nil {
+		c.Tags = make(map[string]string)
+	}
+	for _, key := range source.TransitiveTagKeys {
+		c.Tags[key] = source.Tags[key]
+		c.TransitiveTagKeys = append(c.TransitiveTagKeys, key)
+	}
+}
+
+// tagList returns the credentials' tags as a comma separated list of
+// key=value pairs, the way they are exported as ASSUMED_ROLE_TAGS.
+func (c *tempCredentials) tagList() string {
+	return sessionTags{Tags: c.Tags}.String()
+}
+
+// tags returns the tags to assume the role being asked for with, which is
+// configured with configured: the ones from the flags are added to them.
+func (o *options) tags(configured sessionTags) sessionTags {
+	if o.Tags.IsZero() {
+		return configured
+	}
+	return configured.Merge(o.Tags)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var totpDirPath = fmt.Sprintf("%s/.aws/assume-role/totp", homeDir())
+
+// totpSecrets, when set, holds the TOTP secrets that readTokenCode generates
+// MFA codes from.
+var totpSecrets keyring
+
+// totpSecret is an enrolled RFC 6238 TOTP secret for an MFA device.
+type totpSecret struct {
+	Secret    []byte
+	Algorithm string
+	Digits    int
+	Period    int
+
+	// LastCounter is the last time step a code was generated for. AWS
+	// rejects a code that has already been used, so codes are never
+	// generated twice for the same step.
+	LastCounter int64
+}
+
+// parseTOTPSecret parses a base32 encoded secret or an otpauth:// URI as
+// produced by QR codes for virtual MFA devices.
+func parseTOTPSecret(s string) (*totpSecret, error) {
+	secret := &totpSecret{Algorithm: "SHA1", Digits: 6, Period: 30}
+
+	if strings.HasPrefix(s, "otpauth://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host != "totp" {
+			return nil, fmt.Errorf("unsupported otpauth type %q, only totp is supported", u.Host)
+		}
+
+		q := u.Query()
+		s = q.Get("secret")
+		if v := q.Get("algorithm"); v != "" {
+			secret.Algorithm = strings.ToUpper(v)
+		}
+		if v := q.Get("digits"); v != "" {
+			if secret.Digits, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid digits %q", v)
+			}
+		}
+		if v := q.Get("period"); v != "" {
+			if secret.Period, err = strconv.Atoi(v); err != nil || secret.Period <= 0 {
+				return nil, fmt.Errorf("invalid period %q", v)
+			}
+		}
+	}
+
+	// Secrets are often displayed in groups, lower case and unpadded.
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	if n := len(s) % 8; n != 0 {
+		s += strings.Repeat("=", 8-n)
+	}
+	key, err := base32.StdEncoding.DecodeString(s)
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("secret is not valid base32")
+	}
+	secret.Secret = key
+
+	if secret.Digits < 6 || secret.Digits > 8 {
+		return nil, fmt.Errorf("invalid digits %d", secret.Digits)
+	}
+	if _, err := secret.hash(); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (s *totpSecret) hash() (func() hash.Hash, error) {
+	switch s.Algorithm {
+	case "SHA1":
+		return sha1.New, nil
+	case "SHA256":
+		return sha256.New, nil
+	case "SHA512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", s.Algorithm)
+	}
+}
+
+// Code returns the code for the given time step (RFC 4226 section 5.3).
+func (s *totpSecret) Code(counter int64) (string, error) {
+	h, err := s.hash()
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(h, s.Secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < s.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", s.Digits, value%mod), nil
+}
+
+// generateTOTP returns a code for the MFA device mfa if a secret is enrolled
+// for it. If a code was already generated in the current time step it waits
+// for the next one.
+func generateTOTP(secrets keyring, mfa string) (code string, ok bool, err error) {
+	key := cacheKey("totp", mfa)
+
+	raw, err := secrets.Get(key)
+	if err == errKeyNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	var secret totpSecret
+	if err := json.Unmarshal(raw, &secret); err != nil {
+		return "", false, fmt.Errorf("TOTP secret for %s is corrupt: %v", mfa, err)
+	}
+
+	period := time.Duration(secret.Period) * time.Second
+	counter := time.Now().Unix() / int64(secret.Period)
+	if counter <= secret.LastCounter {
+		wait := time.Unix((secret.LastCounter+1)*int64(secret.Period), 0).Sub(time.Now())
+		if wait > period {
+			// The clock went backwards; don't wait forever.
+			return "", false, fmt.Errorf("a TOTP code for %s was already used in a later time step", mfa)
+		}
+		fmt.Fprintf(os.Stderr, "Waiting %ds for a new MFA code...\n", int(wait.Seconds())+1)
+		time.Sleep(wait)
+		counter = secret.LastCounter + 1
+	}
+
+	code, err = secret.Code(counter)
+	if err != nil {
+		return "", false, err
+	}
+
+	secret.LastCounter = counter
+	raw, err = json.Marshal(&secret)
+	if err != nil {
+		return "", false, err
+	}
+	return code, true, secrets.Set(key, raw)
+}
+
+// totp implements `assume-role totp`, which manages enrolled TOTP secrets.
+func totp(args []string, secrets keyring) error {
+	if len(args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	command, mfa := args[0], args[1]
+	key := cacheKey("totp", mfa)
+
+	switch command {
+	case "enroll":
+		var s string
+		if len(args) > 2 {
+			s = args[2]
+		} else {
+			var err error
+			if s, err = readPassphrase("TOTP secret or otpauth:// URI: "); err != nil {
+				return err
+			}
+		}
+
+		secret, err := parseTOTPSecret(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(secret)
+		if err != nil {
+			return err
+		}
+		if err := secrets.Set(key, raw); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Enrolled TOTP secret for %s\n", mfa)
+		return nil
+	case "remove":
+		if err := secrets.Remove(key); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Removed TOTP secret for %s\n", mfa)
+		return nil
+	default:
+		usage()
+		os.Exit(1)
+	}
+	return nil
+}
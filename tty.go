@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// tty is the controlling terminal, which prompts use when stdin and stdout
+// belong to another program.
+type tty struct {
+	In  *os.File
+	Out *os.File
+}
+
+// openTTY opens the controlling terminal.
+func openTTY() (*tty, error) {
+	if runtime.GOOS == "windows" {
+		in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		return &tty{In: in, Out: out}, nil
+	}
+
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &tty{In: f, Out: f}, nil
+}
+
+// Close closes the terminal.
+func (t *tty) Close() error {
+	if t.Out != t.In {
+		t.Out.Close()
+	}
+	return t.In.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// webIdentityTokenTimeout is how long a web_identity_token_process may take
+// to print a token.
+const webIdentityTokenTimeout = time.Minute
+
+// webIdentityToken returns the current OIDC token for the profile, read from
+// its web_identity_token_file or printed by its web_identity_token_process.
+func webIdentityToken(prof *profile) (string, error) {
+	if prof.WebIdentityTokenFile != "" {
+		raw, err := ioutil.ReadFile(prof.WebIdentityTokenFile)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(raw))
+		if token == "" {
+			return "", fmt.Errorf("web_identity_token_file %s is empty", prof.WebIdentityTokenFile)
+		}
+		return token, nil
+	}
+
+	token, err := runProcess("web_identity_token_process", prof.WebIdentityTokenProcess, webIdentityTokenTimeout)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", fmt.Errorf("web_identity_token_process %q did not print a token", prof.WebIdentityTokenProcess)
+	}
+	return token, nil
+}
+
+// assumeRoleWithWebIdentity assumes the profile's role with its web identity
+// token, scoped down by policy. The call is unsigned, so no other credentials
+// are needed.
+func assumeRoleWithWebIdentity(prof *profile, duration time.Duration, sessionName string, policy sessionPolicy) (*tempCredentials, error) {
+	sessionName, err := renderSessionName(sessionName, prof.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := webIdentityToken(prof)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := newSession(nil, roleRegion(prof.RoleARN, prof.Region))
+
+	params := &sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(prof.RoleARN),
+		RoleSessionName:  aws.String(sessionName),
+		WebIdentityToken: aws.String(token),
+		DurationSeconds:  aws.Int64(int64(duration / time.Second)),
+		PolicyArns:       policy.policyARNs(),
+	}
+	if policy.Document != "" {
+		params.Policy = aws.String(policy.Document)
+	}
+	policy.warnSize()
+
+	resp, err := sts.New(sess).AssumeRoleWithWebIdentity(params)
+	if err != nil {
+		return nil, err
+	}
+	warnPackedPolicySize(resp.PackedPolicySize)
+
+	var creds tempCredentials
+	creds.AccessKeyID = *resp.Credentials.AccessKeyId
+	creds.SecretAccessKey = *resp.Credentials.SecretAccessKey
+	creds.SessionToken = *resp.Credentials.SessionToken
+	creds.Expiration = *resp.Credentials.Expiration
+	creds.AssumedRoleARN = *resp.AssumedRoleUser.Arn
+	creds.RoleSessionName = sessionName
+	creds.Region = aws.StringValue(sess.Config.Region)
+	return &creds, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// whoamiOutput is the JSON document printed by `assume-role whoami -json`.
+type whoamiOutput struct {
+	Account     string
+	ARN         string     `json:"Arn"`
+	UserID      string     `json:"UserId"`
+	AssumedRole string     `json:",omitempty"`
+	Expiration  *time.Time `json:",omitempty"`
+	Remaining   string     `json:",omitempty"`
+
+	// Tags are the session tags exported along with the credentials.
+	Tags map[string]string `json:",omitempty"`
+}
+
+// environmentExpiration returns the expiration exported along with the
+// current credentials, if any.
+func environmentExpiration() (time.Time, error) {
+	for _, name := range []string{"ASSUMED_ROLE_EXPIRATION", "AWS_CREDENTIAL_EXPIRATION"} {
+		if v := os.Getenv(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("%s: %v", name, err)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// whoami implements `assume-role whoami`, which shows who the current
+// credentials belong to and how long they remain valid.
+func whoami(args []string) error {
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the identity as JSON.")
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	expiration, err := environmentExpiration()
+	if err != nil {
+		return err
+	}
+	if !expiration.IsZero() && !time.Now().Before(expiration) {
+		return fmt.Errorf("credentials expired at %s", expiration.Local().Format(time.RFC1123))
+	}
+
+	sess := newSession(nil, "")
+	if aws.StringValue(sess.Config.Region) == "" {
+		// STS is global, so any region will do.
+		sess.Config.WithRegion("us-east-1")
+	}
+
+	resp, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return err
+	}
+
+	out := &whoamiOutput{
+		Account:     aws.StringValue(resp.Account),
+		ARN:         aws.StringValue(resp.Arn),
+		UserID:      aws.StringValue(resp.UserId),
+		AssumedRole: os.Getenv("ASSUMED_ROLE"),
+	}
+	if list := os.Getenv("ASSUMED_ROLE_TAGS"); list != "" {
+		tags, err := parseTags(splitList(list), nil)
+		if err != nil {
+			return fmt.Errorf("ASSUMED_ROLE_TAGS: %v", err)
+		}
+		out.Tags = tags.Tags
+	}
+	if !expiration.IsZero() {
+		expiration = expiration.UTC()
+		out.Expiration = &expiration
+		out.Remaining = (expiration.Sub(time.Now()) / time.Second * time.Second).String()
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Account:\t%s\n", out.Account)
+	fmt.Fprintf(w, "ARN:\t%s\n", out.ARN)
+	fmt.Fprintf(w, "User ID:\t%s\n", out.UserID)
+	if out.AssumedRole != "" {
+		fmt.Fprintf(w, "Assumed role:\t%s\n", out.AssumedRole)
+	}
+	if len(out.Tags) > 0 {
+		fmt.Fprintf(w, "Tags:\t%s\n", sessionTags{Tags: out.Tags})
+	}
+	if out.Expiration != nil {
+		fmt.Fprintf(w, "Expires:\t%s (in %s)\n", out.Expiration.Local().Format(time.RFC1123), out.Remaining)
+	}
+	return w.Flush()
+}